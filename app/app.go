@@ -0,0 +1,320 @@
+// Package app 管理服务的生命周期: 启动服务、注册实例、监听退出信号、注销实例并停止服务
+package app
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yanglunara/discovery/register"
+	"github.com/yanglunara/discovery/transport"
+	"golang.org/x/sync/errgroup"
+)
+
+// Server 可由 App 管理的服务, grpc 与 http 的 Server 均实现了该接口
+type Server interface {
+	transport.GrpcService
+	transport.EndPointer
+}
+
+// Hook 生命周期钩子
+type Hook func(ctx context.Context) error
+
+// Option 应用选项
+type Option func(o *options)
+
+type options struct {
+	id        string
+	name      string
+	version   string
+	metadata  map[string]string
+	endpoints []string // 为空时使用各服务的 Endpoint
+
+	ctx              context.Context
+	signals          []os.Signal
+	servers          []Server
+	registrar        register.Registrar
+	registrarTimeout time.Duration
+	stopTimeout      time.Duration
+
+	beforeStart []Hook
+	afterStart  []Hook
+	beforeStop  []Hook
+	afterStop   []Hook
+}
+
+// ID 设置实例ID, 默认随机生成
+func ID(id string) Option {
+	return func(o *options) {
+		o.id = id
+	}
+}
+
+// Name 设置服务名称
+func Name(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// Version 设置服务版本
+func Version(version string) Option {
+	return func(o *options) {
+		o.version = version
+	}
+}
+
+// Metadata 设置实例元数据
+func Metadata(md map[string]string) Option {
+	return func(o *options) {
+		o.metadata = md
+	}
+}
+
+// Endpoint 显式设置注册的端点, 如经过 NAT 或负载均衡时的外部地址
+func Endpoint(endpoints ...string) Option {
+	return func(o *options) {
+		o.endpoints = endpoints
+	}
+}
+
+// Context 设置应用的上下文, 上下文结束时应用退出
+func Context(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+// Signal 设置触发退出的信号, 默认 SIGTERM、SIGQUIT、SIGINT
+func Signal(sigs ...os.Signal) Option {
+	return func(o *options) {
+		o.signals = sigs
+	}
+}
+
+// Servers 设置需要启动的服务
+func Servers(srv ...Server) Option {
+	return func(o *options) {
+		o.servers = srv
+	}
+}
+
+// Registrar 设置注册中心
+func Registrar(r register.Registrar) Option {
+	return func(o *options) {
+		o.registrar = r
+	}
+}
+
+// RegistrarTimeout 设置注册与注销的超时时间
+func RegistrarTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.registrarTimeout = d
+	}
+}
+
+// StopTimeout 设置停止服务的超时时间
+func StopTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.stopTimeout = d
+	}
+}
+
+// BeforeStart 启动服务前执行, 返回错误时不再启动
+func BeforeStart(fn Hook) Option {
+	return func(o *options) {
+		o.beforeStart = append(o.beforeStart, fn)
+	}
+}
+
+// AfterStart 服务启动并完成注册后执行
+func AfterStart(fn Hook) Option {
+	return func(o *options) {
+		o.afterStart = append(o.afterStart, fn)
+	}
+}
+
+// BeforeStop 收到退出信号后、注销实例前执行
+func BeforeStop(fn Hook) Option {
+	return func(o *options) {
+		o.beforeStop = append(o.beforeStop, fn)
+	}
+}
+
+// AfterStop 所有服务停止后执行
+func AfterStop(fn Hook) Option {
+	return func(o *options) {
+		o.afterStop = append(o.afterStop, fn)
+	}
+}
+
+type App struct {
+	opts     options
+	ctx      context.Context
+	cancel   context.CancelFunc
+	lock     sync.Mutex
+	instance *register.ServiceInstance
+}
+
+func New(opts ...Option) *App {
+	o := options{
+		ctx:              context.Background(),
+		signals:          []os.Signal{syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT},
+		registrarTimeout: 10 * time.Second,
+		stopTimeout:      10 * time.Second,
+	}
+	if id, err := uuid.NewUUID(); err == nil {
+		o.id = id.String()
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	ctx, cancel := context.WithCancel(o.ctx)
+	return &App{
+		opts:   o,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Run 启动所有服务, 监听器就绪后注册实例, 阻塞直到收到退出信号、调用 Stop 或服务出错
+func (a *App) Run() error {
+	instance, err := a.buildInstance()
+	if err != nil {
+		return err
+	}
+	// 注册前开始监听信号, 避免注册后、监听前收到的信号被默认处理直接退出
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, a.opts.signals...)
+	defer signal.Stop(c)
+
+	for _, fn := range a.opts.beforeStart {
+		if err = fn(a.ctx); err != nil {
+			return err
+		}
+	}
+	eg, ctx := errgroup.WithContext(a.ctx)
+	for _, srv := range a.opts.servers {
+		srv := srv
+		eg.Go(func() error {
+			<-ctx.Done()
+			stopCtx, cancel := context.WithTimeout(context.Background(), a.opts.stopTimeout)
+			defer cancel()
+			return srv.Stop(stopCtx)
+		})
+		eg.Go(func() error {
+			return srv.Start(ctx)
+		})
+	}
+	// buildInstance 已通过 Endpoint 创建监听器, 此时注册不会把流量导向未就绪的端口
+	if err = a.register(ctx, instance); err == nil {
+		for _, fn := range a.opts.afterStart {
+			if err = fn(ctx); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		// 服务已启动, 注册失败时同样停止服务并执行 AfterStop
+		err = errors.Join(err, a.Stop())
+		_ = eg.Wait()
+		return a.afterStop(err)
+	}
+	eg.Go(func() error {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c:
+			return a.Stop()
+		}
+	})
+	err = eg.Wait()
+	if errors.Is(err, context.Canceled) {
+		err = nil
+	}
+	// 服务出错退出或启动期间调用了 Stop 时, 实例仍需注销
+	err = errors.Join(err, a.Stop())
+	return a.afterStop(err)
+}
+
+// afterStop 所有服务停止后执行 AfterStop 钩子, 钩子的错误与 err 合并返回
+func (a *App) afterStop(err error) error {
+	for _, fn := range a.opts.afterStop {
+		err = errors.Join(err, fn(context.Background()))
+	}
+	return err
+}
+
+func (a *App) register(ctx context.Context, instance *register.ServiceInstance) error {
+	if a.opts.registrar != nil {
+		rctx, cancel := context.WithTimeout(ctx, a.opts.registrarTimeout)
+		defer cancel()
+		if err := a.opts.registrar.Register(rctx, instance); err != nil {
+			return err
+		}
+	}
+	a.lock.Lock()
+	a.instance = instance
+	a.lock.Unlock()
+	return nil
+}
+
+// Stop 先注销实例再停止服务, 注销完成前服务仍在处理请求
+func (a *App) Stop() (err error) {
+	a.lock.Lock()
+	instance := a.instance
+	a.instance = nil
+	a.lock.Unlock()
+	if instance == nil {
+		a.cancel()
+		return nil
+	}
+	for _, fn := range a.opts.beforeStop {
+		err = errors.Join(err, fn(a.ctx))
+	}
+	if a.opts.registrar != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), a.opts.registrarTimeout)
+		defer cancel()
+		err = errors.Join(err, a.opts.registrar.Deregister(ctx, instance))
+	}
+	a.cancel()
+	return err
+}
+
+// Instance 返回已注册的服务实例, 未注册或已注销时返回 nil
+func (a *App) Instance() *register.ServiceInstance {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.instance
+}
+
+func (a *App) buildInstance() (*register.ServiceInstance, error) {
+	endpoints := make([]string, 0, len(a.opts.servers))
+	// 即使显式设置了端点也调用 Endpoint, 保证注册前监听器已创建
+	for _, srv := range a.opts.servers {
+		u, err := srv.Endpoint()
+		if err != nil {
+			return nil, err
+		}
+		if u == nil {
+			return nil, errors.New("app: server returned empty endpoint")
+		}
+		endpoints = append(endpoints, u.String())
+	}
+	if len(a.opts.endpoints) > 0 {
+		endpoints = a.opts.endpoints
+	}
+	return &register.ServiceInstance{
+		ID:        a.opts.id,
+		Name:      a.opts.name,
+		Version:   a.opts.version,
+		Metadata:  a.opts.metadata,
+		Endpoints: endpoints,
+		LastTs:    time.Now().Unix(),
+	}, nil
+}
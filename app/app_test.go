@@ -0,0 +1,274 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/yanglunara/discovery/register"
+	tgrpc "github.com/yanglunara/discovery/transport/grpc"
+	thttp "github.com/yanglunara/discovery/transport/http"
+	"github.com/yanglunara/discovery/watcher/memory"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// orderedRegistry 记录注册、注销与服务停止的先后顺序
+type orderedRegistry struct {
+	*memory.Registry
+	lock   sync.Mutex
+	events []string
+}
+
+func (r *orderedRegistry) record(event string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *orderedRegistry) Register(ctx context.Context, in *register.ServiceInstance) error {
+	r.record("register")
+	return r.Registry.Register(ctx, in)
+}
+
+func (r *orderedRegistry) Deregister(ctx context.Context, in *register.ServiceInstance) error {
+	r.record("deregister")
+	return r.Registry.Deregister(ctx, in)
+}
+
+// failedRegistry 注册总是失败
+type failedRegistry struct {
+	*memory.Registry
+	err error
+}
+
+func (r *failedRegistry) Register(context.Context, *register.ServiceInstance) error {
+	return r.err
+}
+
+// waitRegistered 等待服务出现在注册中心
+func waitRegistered(t *testing.T, r register.Discovery, name string) []*register.ServiceInstance {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if ins, _ := r.GetService(context.Background(), name); len(ins) > 0 {
+			return ins
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("service %s not registered", name)
+	return nil
+}
+
+func TestApp(t *testing.T) {
+	r := &orderedRegistry{Registry: memory.NewRegistry()}
+	srv := thttp.NewServer(thttp.Address("127.0.0.1:0"))
+	srv.HandleFunc("/ping", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "pong")
+	})
+	app := New(
+		ID("1"),
+		Name("helloworld"),
+		Version("v1"),
+		Metadata(map[string]string{"zone": "a"}),
+		Servers(srv),
+		Registrar(r),
+		BeforeStart(func(context.Context) error {
+			r.record("before_start")
+			return nil
+		}),
+		AfterStop(func(context.Context) error {
+			r.record("after_stop")
+			return nil
+		}),
+	)
+	done := make(chan error, 1)
+	go func() {
+		done <- app.Run()
+	}()
+
+	ins := waitRegistered(t, r, "helloworld")
+	if len(ins[0].Endpoints) != 1 || ins[0].Version != "v1" || ins[0].Metadata["zone"] != "a" {
+		t.Fatalf("unexpected instance %+v", ins[0])
+	}
+	// 注册时监听器已就绪, 可以直接访问
+	resp, err := http.Get(ins[0].Endpoints[0] + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "pong" {
+		t.Fatalf("body = %q", body)
+	}
+
+	if err = app.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("app did not stop")
+	}
+	if ins, _ = r.GetService(context.Background(), "helloworld"); len(ins) != 0 {
+		t.Fatalf("instance not deregistered: %+v", ins)
+	}
+	want := []string{"before_start", "register", "deregister", "after_stop"}
+	if len(r.events) != len(want) {
+		t.Fatalf("events = %v, want %v", r.events, want)
+	}
+	for i := range want {
+		if r.events[i] != want[i] {
+			t.Fatalf("events = %v, want %v", r.events, want)
+		}
+	}
+}
+
+func TestApp_Signal(t *testing.T) {
+	r := memory.NewRegistry()
+	app := New(
+		Name("signal"),
+		Servers(thttp.NewServer(thttp.Address("127.0.0.1:0"))),
+		Registrar(r),
+		Signal(syscall.SIGUSR1),
+	)
+	done := make(chan error, 1)
+	go func() {
+		done <- app.Run()
+	}()
+	waitRegistered(t, r, "signal")
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("app did not stop on signal")
+	}
+	if ins, _ := r.GetService(context.Background(), "signal"); len(ins) != 0 {
+		t.Fatalf("instance not deregistered: %+v", ins)
+	}
+}
+
+func TestApp_BeforeStartError(t *testing.T) {
+	r := memory.NewRegistry()
+	wantErr := errors.New("init failed")
+	app := New(
+		Name("failed"),
+		Servers(thttp.NewServer(thttp.Address("127.0.0.1:0"))),
+		Registrar(r),
+		BeforeStart(func(context.Context) error {
+			return wantErr
+		}),
+	)
+	if err := app.Run(); !errors.Is(err, wantErr) {
+		t.Fatalf("err = %v, want %v", err, wantErr)
+	}
+	if ins, _ := r.GetService(context.Background(), "failed"); len(ins) != 0 {
+		t.Fatalf("instance registered: %+v", ins)
+	}
+}
+
+func TestApp_Grpc(t *testing.T) {
+	r := memory.NewRegistry()
+	app := New(
+		Name("grpc"),
+		Servers(tgrpc.NewGrpcServer(tgrpc.Address("127.0.0.1:0"), tgrpc.OpenHealth())),
+		Registrar(r),
+	)
+	done := make(chan error, 1)
+	go func() {
+		done <- app.Run()
+	}()
+
+	ins := waitRegistered(t, r, "grpc")
+	u, err := url.Parse(ins[0].Endpoints[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "grpc" {
+		t.Fatalf("unexpected endpoint %s", ins[0].Endpoints[0])
+	}
+	conn, err := grpc.NewClient(u.Host, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		t.Fatalf("status = %v", resp.Status)
+	}
+
+	if err = app.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("app did not stop")
+	}
+	if ins, _ = r.GetService(context.Background(), "grpc"); len(ins) != 0 {
+		t.Fatalf("instance not deregistered: %+v", ins)
+	}
+}
+
+func TestApp_RegisterError(t *testing.T) {
+	wantErr := errors.New("register failed")
+	r := &failedRegistry{Registry: memory.NewRegistry(), err: wantErr}
+	srv := thttp.NewServer(thttp.Address("127.0.0.1:0"))
+	var stopped bool
+	app := New(
+		Name("failed"),
+		Servers(srv),
+		Registrar(r),
+		AfterStop(func(context.Context) error {
+			stopped = true
+			return nil
+		}),
+	)
+	done := make(chan error, 1)
+	go func() {
+		done <- app.Run()
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, wantErr) {
+			t.Fatalf("err = %v, want %v", err, wantErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("app did not stop after register failure")
+	}
+	// 服务已启动, 注册失败时服务停止且执行 AfterStop
+	if !stopped {
+		t.Fatal("AfterStop hook not called")
+	}
+	endpoint, _ := srv.Endpoint()
+	if resp, err := http.Get(endpoint.String()); err == nil {
+		_ = resp.Body.Close()
+		t.Fatal("server still serving after register failure")
+	}
+}
@@ -0,0 +1,168 @@
+// Package p2c 实现基于 peak-EWMA 延迟与在途请求数的 P2C(power of two choices) 负载均衡器
+//
+// 使用方式:
+//
+//	import _ "github.com/yanglunara/discovery/balancer/p2c"
+//
+//	grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"discovery_p2c":{}}]}`)
+package p2c
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Name 负载均衡器名称
+	Name = "discovery_p2c"
+
+	decayTime = 10 * time.Second       // EWMA 衰减时间常数
+	forcePick = time.Second            // 节点超过该时间未被选中时强制选中一次, 刷新延迟统计
+	penalty   = 250 * time.Millisecond // 请求失败时计入的延迟
+	initLag   = time.Millisecond       // 新节点的初始延迟, 避免冷启动时全部流量打到新节点
+)
+
+var (
+	_ balancer.Builder   = (*p2cBuilder)(nil)
+	_ base.PickerBuilder = (*pickerBuilder)(nil)
+	_ balancer.Picker    = (*picker)(nil)
+)
+
+func init() {
+	balancer.Register(&p2cBuilder{})
+}
+
+type p2cBuilder struct{}
+
+// Build 每个连接使用独立的统计数据, 连接状态变化重建 picker 时保留节点的延迟统计
+func (*p2cBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &pickerBuilder{nodes: make(map[balancer.SubConn]*node)}
+	return base.NewBalancerBuilder(Name, pb, base.Config{HealthCheck: true}).Build(cc, opts)
+}
+
+func (*p2cBuilder) Name() string {
+	return Name
+}
+
+type pickerBuilder struct {
+	lock  sync.Mutex
+	nodes map[balancer.SubConn]*node
+}
+
+func (b *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	nodes := make(map[balancer.SubConn]*node, len(info.ReadySCs))
+	ready := make([]*node, 0, len(info.ReadySCs))
+	for sc := range info.ReadySCs {
+		n, ok := b.nodes[sc]
+		if !ok {
+			n = newNode(sc)
+		}
+		nodes[sc] = n
+		ready = append(ready, n)
+	}
+	b.nodes = nodes
+	return &picker{
+		nodes: ready,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// node 节点统计, 所有时间以纳秒保存
+type node struct {
+	sc       balancer.SubConn
+	lag      atomic.Int64 // peak-EWMA 延迟
+	inflight atomic.Int64 // 在途请求数
+	stamp    atomic.Int64 // 最近一次更新延迟的时间
+	picked   atomic.Int64 // 最近一次被选中的时间
+}
+
+func newNode(sc balancer.SubConn) *node {
+	n := &node{sc: sc}
+	now := time.Now().UnixNano()
+	n.lag.Store(int64(initLag))
+	n.stamp.Store(now)
+	n.picked.Store(now)
+	return n
+}
+
+// load 节点负载: 延迟 * (在途请求数 + 1)
+func (n *node) load() float64 {
+	return float64(n.lag.Load()) * float64(n.inflight.Load()+1)
+}
+
+// observe 更新 peak-EWMA: 延迟高于当前值时直接取峰值, 否则按距上次更新的时间衰减
+func (n *node) observe(rtt time.Duration, now int64) {
+	last := n.stamp.Swap(now)
+	td := now - last
+	if td < 0 {
+		td = 0
+	}
+	lag := n.lag.Load()
+	if int64(rtt) > lag {
+		n.lag.Store(int64(rtt))
+		return
+	}
+	w := math.Exp(-float64(td) / float64(decayTime))
+	n.lag.Store(int64(float64(lag)*w + float64(rtt)*(1-w)))
+}
+
+type picker struct {
+	nodes []*node
+	lock  sync.Mutex
+	rand  *rand.Rand
+}
+
+// Pick 随机选择两个节点, 取负载较低者; 较差的节点长时间未被选中时强制选中一次
+func (p *picker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	var chosen *node
+	if len(p.nodes) == 1 {
+		chosen = p.nodes[0]
+	} else {
+		p.lock.Lock()
+		a := p.rand.Intn(len(p.nodes))
+		b := p.rand.Intn(len(p.nodes) - 1)
+		p.lock.Unlock()
+		if b >= a {
+			b++
+		}
+		nodeA, nodeB := p.nodes[a], p.nodes[b]
+		if nodeA.load() > nodeB.load() {
+			nodeA, nodeB = nodeB, nodeA
+		}
+		chosen = nodeA
+		// 只允许一个请求强制选中较差的节点
+		now := time.Now().UnixNano()
+		if pk := nodeB.picked.Load(); now-pk > int64(forcePick) && nodeB.picked.CompareAndSwap(pk, now) {
+			chosen = nodeB
+		}
+	}
+	start := time.Now()
+	chosen.picked.Store(start.UnixNano())
+	chosen.inflight.Add(1)
+	return balancer.PickResult{
+		SubConn: chosen.sc,
+		Done: func(info balancer.DoneInfo) {
+			chosen.inflight.Add(-1)
+			now := time.Now()
+			rtt := now.Sub(start)
+			// 调用方取消的请求不计入失败
+			if info.Err != nil && status.Code(info.Err) != codes.Canceled && rtt < penalty {
+				rtt = penalty
+			}
+			chosen.observe(rtt, now.UnixNano())
+		},
+	}, nil
+}
@@ -0,0 +1,85 @@
+package p2c
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+type fakeSubConn struct {
+	balancer.SubConn
+	id string
+}
+
+func build(pb *pickerBuilder, scs ...balancer.SubConn) balancer.Picker {
+	info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for _, sc := range scs {
+		info.ReadySCs[sc] = base.SubConnInfo{Address: resolver.Address{Addr: sc.(*fakeSubConn).id}}
+	}
+	return pb.Build(info)
+}
+
+func TestPicker_AvoidsSlowNode(t *testing.T) {
+	pb := &pickerBuilder{nodes: make(map[balancer.SubConn]*node)}
+	slow, a, b := &fakeSubConn{id: "slow"}, &fakeSubConn{id: "a"}, &fakeSubConn{id: "b"}
+	p := build(pb, slow, a, b)
+	pb.nodes[slow].observe(100*time.Millisecond, time.Now().UnixNano())
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		res, err := p.Pick(balancer.PickInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[res.SubConn.(*fakeSubConn).id]++
+		res.Done(balancer.DoneInfo{})
+	}
+	// 慢节点只会在超过 forcePick 未被选中时被强制选中
+	if counts["slow"] > 10 {
+		t.Fatalf("slow node picked too often: %v", counts)
+	}
+
+	// 重建 picker 时保留统计数据
+	p = build(pb, slow, a)
+	if lag := pb.nodes[slow].lag.Load(); lag < int64(10*time.Millisecond) {
+		t.Fatalf("expected stats to survive rebuild, got lag %v", time.Duration(lag))
+	}
+	if len(pb.nodes) != 2 {
+		t.Fatalf("expected removed node to be released, got %d nodes", len(pb.nodes))
+	}
+}
+
+func TestPicker_Inflight(t *testing.T) {
+	pb := &pickerBuilder{nodes: make(map[balancer.SubConn]*node)}
+	a, b := &fakeSubConn{id: "a"}, &fakeSubConn{id: "b"}
+	p := build(pb, a, b)
+
+	// 不结束的请求会增加节点负载, 之后的请求转向另一个节点
+	first, _ := p.Pick(balancer.PickInfo{})
+	for i := 0; i < 10; i++ {
+		if _, err := p.Pick(balancer.PickInfo{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pb.nodes[a].inflight.Load() == 0 || pb.nodes[b].inflight.Load() == 0 {
+		t.Fatalf("expected picks to spread by inflight, got a=%d b=%d", pb.nodes[a].inflight.Load(), pb.nodes[b].inflight.Load())
+	}
+
+	// 失败的请求计入惩罚延迟
+	first.Done(balancer.DoneInfo{Err: errors.New("unavailable")})
+	n := pb.nodes[first.SubConn]
+	if lag := time.Duration(n.lag.Load()); lag < penalty {
+		t.Fatalf("expected penalty latency, got %v", lag)
+	}
+
+	if _, err := pb.Build(base.PickerBuildInfo{}).Pick(balancer.PickInfo{}); err != balancer.ErrNoSubConnAvailable {
+		t.Fatalf("expected ErrNoSubConnAvailable, got %v", err)
+	}
+	if balancer.Get(Name) == nil {
+		t.Fatalf("balancer %s not registered", Name)
+	}
+}
@@ -0,0 +1,188 @@
+// Package ringhash 实现一致性哈希负载均衡器, 相同哈希键的请求落到同一实例
+//
+// 使用方式:
+//
+//	import _ "github.com/yanglunara/discovery/balancer/ringhash"
+//
+//	grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"discovery_ring_hash":{}}]}`)
+//
+//	// 通过上下文或 outgoing metadata 指定哈希键
+//	ctx = ringhash.WithHashKey(ctx, userID)
+//	ctx = metadata.AppendToOutgoingContext(ctx, ringhash.MetadataKey, userID)
+package ringhash
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yanglunara/discovery/builder"
+	"github.com/yanglunara/discovery/lib"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	// Name 负载均衡器名称
+	Name = "discovery_ring_hash"
+	// MetadataKey outgoing metadata 中的哈希键, 上下文中未设置哈希键时使用
+	MetadataKey = "x-hash-key"
+
+	replicas = 160 // 每个实例在环上的虚拟节点数
+)
+
+var (
+	_ base.PickerBuilder = (*pickerBuilder)(nil)
+	_ balancer.Picker    = (*picker)(nil)
+	_ balancer.Balancer  = (*ringBalancer)(nil)
+)
+
+func init() {
+	balancer.Register(&ringBuilder{})
+}
+
+type hashKey struct{}
+
+// WithHashKey 在上下文中设置哈希键, 优先于 outgoing metadata
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKey{}, key)
+}
+
+// HashKey 读取请求的哈希键
+func HashKey(ctx context.Context) (string, bool) {
+	if key, ok := ctx.Value(hashKey{}).(string); ok && key != "" {
+		return key, true
+	}
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		if values := md.Get(MetadataKey); len(values) > 0 && values[0] != "" {
+			return values[0], true
+		}
+	}
+	return "", false
+}
+
+// ringBuilder 为每个连接创建独立的 pickerBuilder, 以便保存解析器下发的全部地址
+type ringBuilder struct{}
+
+func (*ringBuilder) Name() string {
+	return Name
+}
+
+func (*ringBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &pickerBuilder{}
+	return &ringBalancer{
+		Balancer: base.NewBalancerBuilder(Name, pb, base.Config{HealthCheck: true}).Build(cc, opts),
+		pb:       pb,
+	}
+}
+
+// ringBalancer 在 base 负载均衡器生成 picker 前更新哈希环
+type ringBalancer struct {
+	balancer.Balancer
+	pb *pickerBuilder
+}
+
+func (b *ringBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	b.pb.update(s.ResolverState.Addresses)
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+func (b *ringBalancer) ExitIdle() {
+	if ei, ok := b.Balancer.(balancer.ExitIdler); ok {
+		ei.ExitIdle()
+	}
+}
+
+// pickerBuilder 哈希环由解析器下发的全部地址构成, 连接状态变化不改变环,
+// 实例短暂处于 CONNECTING/IDLE 时只有落在该实例上的键临时迁移
+type pickerBuilder struct {
+	lock sync.Mutex
+	ring []point
+}
+
+// update 地址变化时重建哈希环, 实例增减时只有相邻区间的键会迁移
+func (b *pickerBuilder) update(addrs []resolver.Address) {
+	ring := make([]point, 0, len(addrs)*replicas)
+	seen := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		key := nodeKey(addr)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		for i := 0; i < replicas; i++ {
+			ring = append(ring, point{hash: lib.Hash(key + "#" + strconv.Itoa(i)), node: key})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	b.lock.Lock()
+	b.ring = ring
+	b.lock.Unlock()
+}
+
+func (b *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	b.lock.Lock()
+	ring := b.ring
+	b.lock.Unlock()
+	p := &picker{
+		ring:  ring,
+		ready: make(map[string]balancer.SubConn, len(info.ReadySCs)),
+		scs:   make([]balancer.SubConn, 0, len(info.ReadySCs)),
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for sc, sci := range info.ReadySCs {
+		p.ready[nodeKey(sci.Address)] = sc
+		p.scs = append(p.scs, sc)
+	}
+	return p
+}
+
+// nodeKey 环上节点的标识, 使用实例ID使地址变化时位置不变
+func nodeKey(addr resolver.Address) string {
+	if in, ok := builder.ServiceInstance(addr); ok && in.ID != "" {
+		return in.ID
+	}
+	return addr.Addr
+}
+
+type point struct {
+	hash uint64
+	node string
+}
+
+type picker struct {
+	ring  []point                     // 全部实例的哈希环, 只读
+	ready map[string]balancer.SubConn // 节点标识 -> 就绪的连接
+	scs   []balancer.SubConn
+	lock  sync.Mutex
+	rand  *rand.Rand
+}
+
+// Pick 顺时针查找第一个不小于键哈希且已就绪的节点, 没有哈希键时随机选择
+func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	if key, ok := HashKey(info.Ctx); ok {
+		h := lib.Hash(key)
+		i := sort.Search(len(p.ring), func(i int) bool {
+			return p.ring[i].hash >= h
+		})
+		for n := 0; n < len(p.ring); n++ {
+			if sc, ok := p.ready[p.ring[(i+n)%len(p.ring)].node]; ok {
+				return balancer.PickResult{SubConn: sc}, nil
+			}
+		}
+	}
+	p.lock.Lock()
+	sc := p.scs[p.rand.Intn(len(p.scs))]
+	p.lock.Unlock()
+	return balancer.PickResult{SubConn: sc}, nil
+}
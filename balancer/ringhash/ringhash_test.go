@@ -0,0 +1,183 @@
+package ringhash
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yanglunara/discovery/builder"
+	"github.com/yanglunara/discovery/register"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+)
+
+type fakeSubConn struct {
+	balancer.SubConn
+	id string
+}
+
+func address(id string) resolver.Address {
+	return resolver.Address{
+		Addr:               "127.0.0.1:" + id,
+		BalancerAttributes: attributes.New(builder.RawServiceInstance, &register.ServiceInstance{ID: id}),
+	}
+}
+
+// buildRing 以 all 构建哈希环, 只有 ready 中的实例处于就绪状态
+func buildRing(all []string, ready ...string) balancer.Picker {
+	pb := &pickerBuilder{}
+	addrs := make([]resolver.Address, 0, len(all))
+	for _, id := range all {
+		addrs = append(addrs, address(id))
+	}
+	pb.update(addrs)
+	info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for _, id := range ready {
+		info.ReadySCs[&fakeSubConn{id: id}] = base.SubConnInfo{Address: address(id)}
+	}
+	return pb.Build(info)
+}
+
+func build(ids ...string) balancer.Picker {
+	return buildRing(ids, ids...)
+}
+
+func pick(t *testing.T, p balancer.Picker, ctx context.Context) string {
+	t.Helper()
+	res, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.SubConn.(*fakeSubConn).id
+}
+
+func TestPicker(t *testing.T) {
+	p := build("a", "b", "c", "d")
+	ctx := context.Background()
+
+	// 上下文与 metadata 中的相同键落到同一实例
+	if pick(t, p, WithHashKey(ctx, "user-1")) != pick(t, p, metadata.AppendToOutgoingContext(ctx, MetadataKey, "user-1")) {
+		t.Fatal("expected same instance for context value and metadata")
+	}
+
+	// 新增实例时只有少量键迁移, 且只迁移到新实例
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		before[key] = pick(t, p, WithHashKey(ctx, key))
+	}
+	p = build("a", "b", "c", "d", "e")
+	moved := 0
+	for key, id := range before {
+		if got := pick(t, p, WithHashKey(ctx, key)); got != id {
+			if got != "e" {
+				t.Fatalf("key %s moved from %s to existing instance %s", key, id, got)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 350 {
+		t.Fatalf("unexpected moved keys %d", moved)
+	}
+
+	// 没有哈希键时仍可选择实例
+	if id := pick(t, p, ctx); id == "" {
+		t.Fatal("expected random pick without hash key")
+	}
+	if _, err := (&pickerBuilder{}).Build(base.PickerBuildInfo{}).Pick(balancer.PickInfo{Ctx: ctx}); err != balancer.ErrNoSubConnAvailable {
+		t.Fatalf("expected ErrNoSubConnAvailable, got %v", err)
+	}
+	if balancer.Get(Name) == nil {
+		t.Fatalf("balancer %s not registered", Name)
+	}
+}
+
+func TestPicker_NotReady(t *testing.T) {
+	ctx := context.Background()
+	all := []string{"a", "b", "c", "d"}
+	p := build(all...)
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		before[key] = pick(t, p, WithHashKey(ctx, key))
+	}
+
+	// b 短暂不可用时只有落在 b 上的键迁移
+	p = buildRing(all, "a", "c", "d")
+	for key, id := range before {
+		got := pick(t, p, WithHashKey(ctx, key))
+		if id != "b" && got != id {
+			t.Fatalf("key %s moved from ready instance %s to %s", key, id, got)
+		}
+		if got == "b" {
+			t.Fatalf("key %s picked not ready instance", key)
+		}
+	}
+
+	// b 恢复后所有键回到原来的实例
+	p = buildRing(all, all...)
+	for key, id := range before {
+		if got := pick(t, p, WithHashKey(ctx, key)); got != id {
+			t.Fatalf("key %s moved from %s to %s after recovery", key, id, got)
+		}
+	}
+}
+
+func TestBalancer(t *testing.T) {
+	var addrs []resolver.Address
+	for i := 0; i < 3; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := grpc.NewServer()
+		grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+		go func() {
+			_ = srv.Serve(lis)
+		}()
+		t.Cleanup(srv.Stop)
+		addrs = append(addrs, resolver.Address{Addr: lis.Addr().String()})
+	}
+	r := manual.NewBuilderWithScheme("ringhash")
+	r.InitialState(resolver.State{Addresses: addrs})
+	conn, err := grpc.Dial(r.Scheme()+":///test",
+		grpc.WithResolvers(r),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"`+Name+`":{}}]}`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cli := grpc_health_v1.NewHealthClient(conn)
+	check := func() string {
+		var p peer.Peer
+		if _, err := cli.Check(WithHashKey(ctx, "user-1"), &grpc_health_v1.HealthCheckRequest{}, grpc.Peer(&p), grpc.WaitForReady(true)); err != nil {
+			t.Fatal(err)
+		}
+		return p.Addr.String()
+	}
+	// 首次请求时其他连接可能尚未就绪, 等待所有连接就绪后相同的键总是落到同一实例
+	check()
+	time.Sleep(100 * time.Millisecond)
+	want := check()
+	for i := 0; i < 20; i++ {
+		if got := check(); got != want {
+			t.Fatalf("key routed to %s, want %s", got, want)
+		}
+	}
+}
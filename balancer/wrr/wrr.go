@@ -0,0 +1,101 @@
+// Package wrr 实现基于实例元数据权重的平滑加权轮询负载均衡器
+//
+// 使用方式:
+//
+//	import _ "github.com/yanglunara/discovery/balancer/wrr"
+//
+//	grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"discovery_weighted":{}}]}`)
+package wrr
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/yanglunara/discovery/builder"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	// Name 负载均衡器名称
+	Name = "discovery_weighted"
+	// WeightKey 实例元数据中的权重键, 支持小数
+	WeightKey = "weight"
+	// DefaultWeight 未设置或权重非法时使用的默认权重
+	DefaultWeight = 100
+)
+
+var (
+	_ base.PickerBuilder = (*pickerBuilder)(nil)
+	_ balancer.Picker    = (*picker)(nil)
+)
+
+func init() {
+	balancer.Register(newBuilder())
+}
+
+func newBuilder() balancer.Builder {
+	return base.NewBalancerBuilder(Name, &pickerBuilder{}, base.Config{HealthCheck: true})
+}
+
+type pickerBuilder struct{}
+
+// Build 每次地址或连接状态变化时重建, 注册中心中的权重变化随地址更新实时生效
+func (*pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	nodes := make([]*node, 0, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		nodes = append(nodes, &node{
+			sc:     sc,
+			weight: Weight(sci.Address),
+		})
+	}
+	return &picker{nodes: nodes}
+}
+
+// node 平滑加权轮询中的节点
+type node struct {
+	sc      balancer.SubConn
+	weight  float64 // 配置权重
+	current float64 // 当前权重
+}
+
+type picker struct {
+	lock  sync.Mutex
+	nodes []*node
+}
+
+// Pick 平滑加权轮询: 每个节点的当前权重加上配置权重, 选出当前权重最大的节点后减去总权重
+func (p *picker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var (
+		total float64
+		best  *node
+	)
+	for _, n := range p.nodes {
+		n.current += n.weight
+		total += n.weight
+		if best == nil || n.current > best.current {
+			best = n
+		}
+	}
+	best.current -= total
+	return balancer.PickResult{SubConn: best.sc}, nil
+}
+
+// Weight 读取地址对应实例的权重, 未设置或非法时返回 DefaultWeight
+func Weight(addr resolver.Address) float64 {
+	in, ok := builder.ServiceInstance(addr)
+	if !ok {
+		return DefaultWeight
+	}
+	w, err := strconv.ParseFloat(in.Metadata[WeightKey], 64)
+	if err != nil || w <= 0 {
+		return DefaultWeight
+	}
+	return w
+}
@@ -0,0 +1,80 @@
+package wrr
+
+import (
+	"testing"
+
+	"github.com/yanglunara/discovery/builder"
+	"github.com/yanglunara/discovery/register"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+type fakeSubConn struct {
+	balancer.SubConn
+	id string
+}
+
+func address(id, weight string) resolver.Address {
+	in := &register.ServiceInstance{ID: id, Metadata: map[string]string{WeightKey: weight}}
+	return resolver.Address{
+		Addr:               id,
+		BalancerAttributes: attributes.New(builder.RawServiceInstance, in),
+	}
+}
+
+func TestPicker(t *testing.T) {
+	info := base.PickerBuildInfo{ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+		&fakeSubConn{id: "a"}: {Address: address("a", "5")},
+		&fakeSubConn{id: "b"}: {Address: address("b", "1")},
+		&fakeSubConn{id: "c"}: {Address: address("c", "1")},
+	}}
+	p := (&pickerBuilder{}).Build(info)
+
+	counts := make(map[string]int)
+	var seq []string
+	for i := 0; i < 7; i++ {
+		res, err := p.Pick(balancer.PickInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := res.SubConn.(*fakeSubConn).id
+		counts[id]++
+		seq = append(seq, id)
+	}
+	if counts["a"] != 5 || counts["b"] != 1 || counts["c"] != 1 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+	// 平滑加权轮询不会连续选中低权重节点, 高权重节点也会被打散
+	for i := 1; i < len(seq); i++ {
+		if seq[i] != "a" && seq[i-1] != "a" {
+			t.Fatalf("low weight nodes picked consecutively: %v", seq)
+		}
+	}
+
+	if _, err := (&pickerBuilder{}).Build(base.PickerBuildInfo{}).Pick(balancer.PickInfo{}); err != balancer.ErrNoSubConnAvailable {
+		t.Fatalf("expected ErrNoSubConnAvailable, got %v", err)
+	}
+}
+
+func TestWeight(t *testing.T) {
+	tests := []struct {
+		addr resolver.Address
+		want float64
+	}{
+		{addr: address("a", "2.5"), want: 2.5},
+		{addr: address("a", ""), want: DefaultWeight},
+		{addr: address("a", "-1"), want: DefaultWeight},
+		{addr: address("a", "abc"), want: DefaultWeight},
+		{addr: resolver.Address{Addr: "a"}, want: DefaultWeight},
+	}
+	for _, tt := range tests {
+		if got := Weight(tt.addr); got != tt.want {
+			t.Fatalf("want %v, got %v", tt.want, got)
+		}
+	}
+	if balancer.Get(Name) == nil {
+		t.Fatalf("balancer %s not registered", Name)
+	}
+}
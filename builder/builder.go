@@ -3,9 +3,11 @@ package builder
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/yunbaifan/pkg/logger"
 	"go.uber.org/zap"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/api"
@@ -19,11 +21,65 @@ var (
 	_ register.Stopper = (*Builder)(nil)
 )
 
+// ErrClosed 构建器已关闭
+var ErrClosed = errors.New("builder: closed")
+
+// Option 构建器选项
+type Option func(b *Builder)
+
+// WithTimeout 设置创建观察者的超时时间
+func WithTimeout(d time.Duration) Option {
+	return func(b *Builder) {
+		b.tiemout = d
+	}
+}
+
+// WithClearOnEmpty 服务发现返回空实例列表时是否清空地址, 默认保留最后一次可用的地址
+func WithClearOnEmpty(clear bool) Option {
+	return func(b *Builder) {
+		b.clearOnEmpty = clear
+	}
+}
+
+// WithBackoff 设置观察者出错后的重试间隔, 每次失败翻倍直到 max
+func WithBackoff(min, max time.Duration) Option {
+	return func(b *Builder) {
+		b.minBackoff = min
+		b.maxBackoff = max
+	}
+}
+
+// WithSubset 开启确定性子集, 实例数超过 size 时每个客户端只连接按 clientID 选出的 size 个实例
+func WithSubset(clientID string, size int) Option {
+	return func(b *Builder) {
+		b.clientID = clientID
+		b.subsetSize = size
+	}
+}
+
+// WithLocality 设置客户端所在的数据中心与可用区, 优先选择同可用区的实例, 其次同数据中心;
+// 某一层级的健康实例数低于 minHealthy 时降级到下一层级, 最终使用全部实例
+func WithLocality(dc, zone string, minHealthy int) Option {
+	return func(b *Builder) {
+		b.locality = &locality{dc: dc, zone: zone, minHealthy: minHealthy}
+	}
+}
+
+// Builder 同一个构建器可以解析多个目标, 每个目标对应一个独立的解析器
 type Builder struct {
 	discoverer register.Discovery
 	tiemout    time.Duration
-	cancel     context.CancelFunc
-	resolver   resolver.Resolver
+	lock       sync.Mutex
+	resolvers  map[*discoveryResolver]struct{}
+	scopes     map[string]register.Discovery // authority -> 对应作用域的服务发现
+	closed     bool
+
+	clearOnEmpty bool
+	clientID     string
+	subsetSize   int
+	locality     *locality
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
 }
 
 func NewConsulDiscovery(endpoint string) register.Discovery {
@@ -34,11 +90,19 @@ func NewConsulDiscovery(endpoint string) register.Discovery {
 	return consul.NewRegistry(cli)
 }
 
-func NewBuilder(b register.Discovery) resolver.Builder {
-	return &Builder{
+func NewBuilder(b register.Discovery, opts ...Option) *Builder {
+	bu := &Builder{
 		discoverer: b,
 		tiemout:    time.Second * 15,
+		resolvers:  make(map[*discoveryResolver]struct{}),
+		scopes:     make(map[string]register.Discovery),
+		minBackoff: time.Second,
+		maxBackoff: time.Second * 30,
+	}
+	for _, o := range opts {
+		o(bu)
 	}
+	return bu
 }
 
 // Build  grpc 驱动
@@ -48,41 +112,60 @@ func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, _ resolv
 		w   register.Watcher
 	}{}
 	logger.Logger.Info("Grpc Service Success", zap.String("target.URL.Path", target.URL.Path))
+	d, err := b.scope(target.URL.Host)
+	if err != nil {
+		return nil, err
+	}
 	done := make(chan struct{}, 1)
 	ctx, cancel := context.WithCancel(context.Background())
-	b.cancel = cancel
+	name := strings.TrimPrefix(target.URL.Path, "/")
 	go func() {
-		w, err := b.discoverer.Watch(ctx, strings.TrimPrefix(target.URL.Path, "/"))
+		w, err := d.Watch(ctx, name)
 		watchRes.w = w
 		watchRes.err = err
 		close(done)
 	}()
-	var (
-		err error
-	)
-
 	select {
 	case <-done:
 		err = watchRes.err
 	case <-time.After(b.tiemout):
 		err = errors.New("discovery create watcher overtime")
+		// 超时后观察者仍可能创建成功, 创建完成后关闭, 避免泄漏共享的上游观察者
+		go func() {
+			<-done
+			if watchRes.w != nil {
+				_ = watchRes.w.Close()
+			}
+		}()
 	}
 	if err != nil {
-		// 关闭所有资源
+		// 只释放当前目标的资源, 服务发现由其他目标共享
 		cancel()
-		_ = b.discoverer.Close()
 		return nil, err
 	}
 
 	r := &discoveryResolver{
-		w:      watchRes.w,
-		d:      b.discoverer,
-		cc:     cc,
-		ctx:    ctx,
-		cancel: cancel,
+		w:       watchRes.w,
+		d:       d,
+		name:    name,
+		filter:  newFilter(target.URL.Query()),
+		cc:      cc,
+		ctx:     ctx,
+		cancel:  cancel,
+		builder: b,
+		resolve: make(chan struct{}, 1),
+	}
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		cancel()
+		_ = r.w.Close()
+		return nil, ErrClosed
 	}
-	b.resolver = r
+	b.resolvers[r] = struct{}{}
+	b.lock.Unlock()
 	go r.watch()
+	go r.refresh()
 
 	return r, nil
 }
@@ -91,8 +174,56 @@ func (b *Builder) Scheme() string {
 	return "discovery"
 }
 
+// scope 返回 authority 对应的服务发现, 同一个 authority 复用同一个作用域
+func (b *Builder) scope(authority string) (register.Discovery, error) {
+	if authority == "" {
+		return b.discoverer, nil
+	}
+	scoper, ok := b.discoverer.(register.Scoper)
+	if !ok {
+		return nil, fmt.Errorf("discovery does not support authority %q", authority)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	if d, ok := b.scopes[authority]; ok {
+		return d, nil
+	}
+	d, err := scoper.Scope(authority)
+	if err != nil {
+		return nil, err
+	}
+	b.scopes[authority] = d
+	return d, nil
+}
+
+// remove 解析器关闭时从构建器中移除
+func (b *Builder) remove(r *discoveryResolver) {
+	b.lock.Lock()
+	delete(b.resolvers, r)
+	b.lock.Unlock()
+}
+
+// Close 关闭所有解析器后关闭服务发现
 func (b *Builder) Close() error {
-	b.cancel()
-	b.resolver.Close()
-	return nil
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return nil
+	}
+	b.closed = true
+	resolvers := make([]*discoveryResolver, 0, len(b.resolvers))
+	for r := range b.resolvers {
+		resolvers = append(resolvers, r)
+	}
+	b.lock.Unlock()
+	for _, r := range resolvers {
+		r.Close()
+	}
+	for _, d := range b.scopes {
+		_ = d.Close()
+	}
+	return b.discoverer.Close()
 }
@@ -1,44 +1,568 @@
 package builder
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
-	"github.com/hashicorp/consul/api"
-	"github.com/yanglunara/discovery/watcher/consul"
+	"github.com/yanglunara/discovery/register"
+	"github.com/yanglunara/discovery/watcher/memory"
+	"github.com/yunbaifan/pkg/logger"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/resolver"
 	"google.golang.org/grpc/serviceconfig"
 )
 
-type mockConn struct{}
+func init() {
+	logger.Logger = zap.NewNop()
+}
+
+type mockConn struct {
+	states  chan resolver.State
+	errs    chan error
+	configs chan string
+}
 
-func (m *mockConn) UpdateState(resolver.State) error {
+func newMockConn() *mockConn {
+	return &mockConn{
+		states:  make(chan resolver.State, 16),
+		errs:    make(chan error, 16),
+		configs: make(chan string, 16),
+	}
+}
 
+func (m *mockConn) UpdateState(s resolver.State) error {
+	m.states <- s
 	return nil
 }
 
-func (m *mockConn) ReportError(error) {}
+func (m *mockConn) ReportError(err error) {
+	m.errs <- err
+}
 
 func (m *mockConn) NewAddress(_ []resolver.Address) {}
 
 func (m *mockConn) NewServiceConfig(_ string) {}
 
-func (m *mockConn) ParseServiceConfig(_ string) *serviceconfig.ParseResult {
-	return nil
+func (m *mockConn) ParseServiceConfig(js string) *serviceconfig.ParseResult {
+	m.configs <- js
+	if !json.Valid([]byte(js)) {
+		return &serviceconfig.ParseResult{Err: errors.New("invalid service config")}
+	}
+	return &serviceconfig.ParseResult{}
+}
+
+func (m *mockConn) wait(t *testing.T) resolver.State {
+	t.Helper()
+	select {
+	case s := <-m.states:
+		return s
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait resolver state timeout")
+	}
+	return resolver.State{}
 }
 
 func TestBuilder_Build(t *testing.T) {
-	cli, _ := api.NewClient(&api.Config{Address: "host.docker.internal:8500"})
-	re := consul.NewRegistry(cli)
+	ctx := context.Background()
+	re := memory.NewRegistry()
+	_ = re.Register(ctx, &register.ServiceInstance{
+		ID:        "1",
+		Name:      "im.logic",
+		Endpoints: []string{"http://127.0.0.1:8000", "grpc://127.0.0.1:9000"},
+	})
 	b := NewBuilder(re)
-	_, _ = b.Build(
+	cc := newMockConn()
+	r, err := b.Build(
 		resolver.Target{
 			URL: url.URL{
-				Scheme: resolver.GetDefaultScheme(),
-				Path:   "grpc://im.logic",
+				Scheme: "discovery",
+				Path:   "/im.logic",
 			},
 		},
-		&mockConn{},
+		cc,
 		resolver.BuildOptions{},
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	s := cc.wait(t)
+	if len(s.Addresses) != 1 || s.Addresses[0].Addr != "127.0.0.1:9000" {
+		t.Fatalf("unexpected addresses %v", s.Addresses)
+	}
+
+	_ = re.Register(ctx, &register.ServiceInstance{
+		ID:        "2",
+		Name:      "im.logic",
+		Endpoints: []string{"grpc://127.0.0.1:9001"},
+	})
+	if s = cc.wait(t); len(s.Addresses) != 2 {
+		t.Fatalf("unexpected addresses %v", s.Addresses)
+	}
+}
+
+// closeCounter 记录服务发现是否被关闭, 并可以让指定服务的监听失败
+type closeCounter struct {
+	register.Discovery
+	fail   string
+	closed int
+}
+
+func (c *closeCounter) Watch(ctx context.Context, serviceName string) (register.Watcher, error) {
+	if serviceName == c.fail {
+		return nil, errors.New("watch failed")
+	}
+	return c.Discovery.Watch(ctx, serviceName)
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return c.Discovery.Close()
+}
+
+func target(name string) resolver.Target {
+	return resolver.Target{URL: url.URL{Scheme: "discovery", Path: "/" + name}}
+}
+
+func TestBuilder_MultipleTargets(t *testing.T) {
+	ctx := context.Background()
+	re := memory.NewRegistry()
+	d := &closeCounter{Discovery: re, fail: "broken"}
+	b := NewBuilder(d, WithTimeout(time.Second))
+
+	logic, job := newMockConn(), newMockConn()
+	r1, err := b.Build(target("im.logic"), logic, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Build(target("im.job"), job, resolver.BuildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// 失败的目标不影响服务发现
+	if _, err = b.Build(target("broken"), newMockConn(), resolver.BuildOptions{}); err == nil {
+		t.Fatal("expected build error")
+	}
+	if d.closed != 0 {
+		t.Fatal("failed build must not close discovery")
+	}
+
+	// 关闭一个解析器后其他目标继续更新
+	r1.Close()
+	if d.closed != 0 {
+		t.Fatal("resolver close must not close discovery")
+	}
+	_ = re.Register(ctx, &register.ServiceInstance{ID: "1", Name: "im.job", Endpoints: []string{"grpc://127.0.0.1:9100"}})
+	if s := job.wait(t); len(s.Addresses) != 1 || s.Addresses[0].Addr != "127.0.0.1:9100" {
+		t.Fatalf("unexpected addresses %v", s.Addresses)
+	}
+	if len(b.resolvers) != 1 {
+		t.Fatalf("expected 1 tracked resolver, got %d", len(b.resolvers))
+	}
+
+	if err = b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d.closed != 1 || len(b.resolvers) != 0 {
+		t.Fatalf("expected discovery closed once and resolvers released, got %d, %d", d.closed, len(b.resolvers))
+	}
+	if _, err = b.Build(target("im.job"), job, resolver.BuildOptions{}); err == nil {
+		t.Fatal("expected error after close")
+	}
+}
+
+// flakyDiscovery 观察者先失败若干次, GetService 返回预设实例
+type flakyDiscovery struct {
+	register.Discovery
+	failures int
+	lock     sync.Mutex
+	ins      []*register.ServiceInstance
+}
+
+type flakyWatcher struct {
+	register.Watcher
+	d *flakyDiscovery
+}
+
+func (w *flakyWatcher) Next() ([]*register.ServiceInstance, error) {
+	w.d.lock.Lock()
+	if w.d.failures > 0 {
+		w.d.failures--
+		w.d.lock.Unlock()
+		return nil, errors.New("upstream unavailable")
+	}
+	w.d.lock.Unlock()
+	return w.Watcher.Next()
+}
+
+func (d *flakyDiscovery) Watch(ctx context.Context, serviceName string) (register.Watcher, error) {
+	w, err := d.Discovery.Watch(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return &flakyWatcher{Watcher: w, d: d}, nil
+}
+
+func (d *flakyDiscovery) GetService(context.Context, string) ([]*register.ServiceInstance, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.ins, nil
+}
+
+func TestResolver_ErrorsAndResolveNow(t *testing.T) {
+	d := &flakyDiscovery{Discovery: memory.NewRegistry(), failures: 2}
+	b := NewBuilder(d, WithBackoff(10*time.Millisecond, 20*time.Millisecond))
+	defer func() {
+		_ = b.Close()
+	}()
+	cc := newMockConn()
+	r, err := b.Build(target("im.logic"), cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 观察者的错误通过 ReportError 上报
+	for i := 0; i < 2; i++ {
+		select {
+		case <-cc.errs:
+		case <-time.After(3 * time.Second):
+			t.Fatal("expected reported error")
+		}
+	}
+
+	d.lock.Lock()
+	d.ins = []*register.ServiceInstance{{ID: "1", Name: "im.logic", Endpoints: []string{"grpc://127.0.0.1:9000"}}}
+	d.lock.Unlock()
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	if s := cc.wait(t); len(s.Addresses) != 1 || s.Addresses[0].Addr != "127.0.0.1:9000" {
+		t.Fatalf("unexpected addresses %v", s.Addresses)
+	}
+}
+
+func TestResolver_EmptyPolicy(t *testing.T) {
+	for _, clear := range []bool{false, true} {
+		re := memory.NewRegistry()
+		b := NewBuilder(re, WithClearOnEmpty(clear))
+		cc := newMockConn()
+		r, err := b.Build(target("im.logic"), cc, resolver.BuildOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dr := r.(*discoveryResolver)
+		dr.update(dr.seq.Add(1), nil)
+		select {
+		case s := <-cc.states:
+			if !clear || len(s.Addresses) != 0 {
+				t.Fatalf("clear=%v: unexpected state %v", clear, s)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if clear {
+				t.Fatal("expected empty address set")
+			}
+		}
+		_ = b.Close()
+	}
+}
+
+func TestBuilder_TargetQuery(t *testing.T) {
+	ctx := context.Background()
+	re := memory.NewRegistry()
+	_ = re.Register(ctx, &register.ServiceInstance{ID: "1", Name: "im.logic", Version: "v1", Endpoints: []string{"grpc://127.0.0.1:9000"}})
+	_ = re.Register(ctx, &register.ServiceInstance{ID: "2", Name: "im.logic", Version: "v2", Endpoints: []string{"grpc://127.0.0.1:9001"}})
+	b := NewBuilder(re)
+	defer func() {
+		_ = b.Close()
+	}()
+	cc := newMockConn()
+	u, _ := url.Parse("discovery:///im.logic?version=v2")
+	if _, err := b.Build(resolver.Target{URL: *u}, cc, resolver.BuildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if s := cc.wait(t); len(s.Addresses) != 1 || s.Addresses[0].Addr != "127.0.0.1:9001" {
+		t.Fatalf("unexpected addresses %v", s.Addresses)
+	}
+}
+
+// scopedDiscovery 每个 authority 对应一个独立的内存注册中心
+type scopedDiscovery struct {
+	register.Discovery
+	scopes map[string]*memory.Registry
+	calls  int
+}
+
+func (s *scopedDiscovery) Scope(authority string) (register.Discovery, error) {
+	s.calls++
+	d, ok := s.scopes[authority]
+	if !ok {
+		return nil, errors.New("unknown authority")
+	}
+	return d, nil
+}
+
+func TestBuilder_Authority(t *testing.T) {
+	ctx := context.Background()
+	sh, bj := memory.NewRegistry(), memory.NewRegistry()
+	_ = sh.Register(ctx, &register.ServiceInstance{ID: "1", Name: "im.logic", Endpoints: []string{"grpc://10.0.0.1:9000"}})
+	_ = bj.Register(ctx, &register.ServiceInstance{ID: "2", Name: "im.logic", Endpoints: []string{"grpc://10.0.1.1:9000"}})
+	d := &scopedDiscovery{Discovery: memory.NewRegistry(), scopes: map[string]*memory.Registry{"sh": sh, "bj": bj}}
+	b := NewBuilder(d)
+	defer func() {
+		_ = b.Close()
+	}()
+
+	for _, tt := range []struct{ authority, addr string }{{"sh", "10.0.0.1:9000"}, {"bj", "10.0.1.1:9000"}, {"sh", "10.0.0.1:9000"}} {
+		cc := newMockConn()
+		u := url.URL{Scheme: "discovery", Host: tt.authority, Path: "/im.logic"}
+		if _, err := b.Build(resolver.Target{URL: u}, cc, resolver.BuildOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if s := cc.wait(t); len(s.Addresses) != 1 || s.Addresses[0].Addr != tt.addr {
+			t.Fatalf("%s: unexpected addresses %v", tt.authority, s.Addresses)
+		}
+	}
+	if d.calls != 2 {
+		t.Fatalf("expected scopes to be reused, got %d calls", d.calls)
+	}
+	u := url.URL{Scheme: "discovery", Host: "gz", Path: "/im.logic"}
+	if _, err := b.Build(resolver.Target{URL: u}, newMockConn(), resolver.BuildOptions{}); err == nil {
+		t.Fatal("expected error for unknown authority")
+	}
+
+	// 不支持作用域的服务发现拒绝带 authority 的目标
+	plain := NewBuilder(memory.NewRegistry())
+	if _, err := plain.Build(resolver.Target{URL: u}, newMockConn(), resolver.BuildOptions{}); err == nil {
+		t.Fatal("expected error for discovery without scope support")
+	}
+}
+
+func TestResolver_ServiceConfig(t *testing.T) {
+	ctx := context.Background()
+	const sc = `{"methodConfig":[{"name":[{"service":"im.logic"}],"timeout":"1s"}]}`
+	re := memory.NewRegistry()
+	_ = re.Register(ctx, &register.ServiceInstance{ID: "1", Name: "im.logic", Endpoints: []string{"grpc://127.0.0.1:9000"}})
+	_ = re.Register(ctx, &register.ServiceInstance{
+		ID:        "2",
+		Name:      "im.logic",
+		Metadata:  map[string]string{register.ServiceConfigKey: sc},
+		Endpoints: []string{"grpc://127.0.0.1:9001"},
+	})
+	b := NewBuilder(re)
+	defer func() {
+		_ = b.Close()
+	}()
+	cc := newMockConn()
+	if _, err := b.Build(target("im.logic"), cc, resolver.BuildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if s := cc.wait(t); s.ServiceConfig == nil {
+		t.Fatal("expected service config in resolver state")
+	}
+	if js := <-cc.configs; js != sc {
+		t.Fatalf("unexpected service config %s", js)
+	}
+}
+
+func TestResolver_InvalidServiceConfig(t *testing.T) {
+	ctx := context.Background()
+	const sc = `{"methodConfig":[{"name":[{"service":"im.logic"}],"timeout":"1s"}]}`
+	re := memory.NewRegistry()
+	_ = re.Register(ctx, &register.ServiceInstance{
+		ID:        "1",
+		Name:      "im.logic",
+		Metadata:  map[string]string{register.ServiceConfigKey: "{"},
+		Endpoints: []string{"grpc://127.0.0.1:9000"},
+	})
+	_ = re.Register(ctx, &register.ServiceInstance{
+		ID:        "2",
+		Name:      "im.logic",
+		Metadata:  map[string]string{register.ServiceConfigKey: sc},
+		Endpoints: []string{"grpc://127.0.0.1:9001"},
+	})
+	b := NewBuilder(re)
+	defer func() {
+		_ = b.Close()
+	}()
+	cc := newMockConn()
+	if _, err := b.Build(target("im.logic"), cc, resolver.BuildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// 跳过实例 1 的非法配置, 使用实例 2 的配置
+	s := cc.wait(t)
+	if s.ServiceConfig == nil || s.ServiceConfig.Err != nil {
+		t.Fatalf("expected valid service config, got %+v", s.ServiceConfig)
+	}
+	if js := <-cc.configs; js != "{" {
+		t.Fatalf("expected invalid config to be parsed first, got %s", js)
+	}
+	if js := <-cc.configs; js != sc {
+		t.Fatalf("unexpected service config %s", js)
+	}
+}
+
+// countingBalancer 统计创建的 SubConn 数量, 用于检查地址更新时是否重建连接
+type countingBalancer struct {
+	balancer.Builder
+	created atomic.Int32
+}
+
+func (b *countingBalancer) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	return b.Builder.Build(&countingConn{ClientConn: cc, created: &b.created}, opts)
+}
+
+type countingConn struct {
+	balancer.ClientConn
+	created *atomic.Int32
+}
+
+func (c *countingConn) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	c.created.Add(1)
+	return c.ClientConn.NewSubConn(addrs, opts)
+}
+
+type noopPickerBuilder struct{}
+
+func (noopPickerBuilder) Build(base.PickerBuildInfo) balancer.Picker {
+	return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+}
+
+func TestResolver_KeepSubConn(t *testing.T) {
+	ctx := context.Background()
+	re := memory.NewRegistry()
+	_ = re.Register(ctx, &register.ServiceInstance{ID: "1", Name: "im.logic", Endpoints: []string{"grpc://127.0.0.1:9000"}})
+
+	const name = "test_counting"
+	counter := &countingBalancer{Builder: base.NewBalancerBuilder(name, noopPickerBuilder{}, base.Config{})}
+	balancer.Register(counter)
+	conn, err := grpc.NewClient("discovery:///im.logic",
+		grpc.WithResolvers(NewBuilder(re)),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig":[{"`+name+`":{}}]}`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	conn.Connect()
+	waitCreated := func(n int32) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for counter.created.Load() < n && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := counter.created.Load(); got != n {
+			t.Fatalf("created %d subconns, want %d", got, n)
+		}
+	}
+	waitCreated(1)
+
+	// 注册其他实例后, 未变化的实例复用原有的 SubConn
+	_ = re.Register(ctx, &register.ServiceInstance{ID: "2", Name: "im.logic", Endpoints: []string{"grpc://127.0.0.1:9001"}})
+	waitCreated(2)
+	time.Sleep(100 * time.Millisecond)
+	if got := counter.created.Load(); got != 2 {
+		t.Fatalf("created %d subconns, want 2", got)
+	}
+}
+
+// slowDiscovery 在 release 关闭前阻塞 Watch, 并记录返回的观察者是否被关闭
+type slowDiscovery struct {
+	register.Discovery
+	release chan struct{}
+	closed  chan struct{}
+}
+
+type closeNotifier struct {
+	register.Watcher
+	closed chan struct{}
+}
+
+func (w *closeNotifier) Close() error {
+	close(w.closed)
+	return w.Watcher.Close()
+}
+
+func (d *slowDiscovery) Watch(ctx context.Context, serviceName string) (register.Watcher, error) {
+	<-d.release
+	w, err := d.Discovery.Watch(context.Background(), serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return &closeNotifier{Watcher: w, closed: d.closed}, nil
+}
+
+func TestBuilder_WatchTimeout(t *testing.T) {
+	d := &slowDiscovery{Discovery: memory.NewRegistry(), release: make(chan struct{}), closed: make(chan struct{})}
+	b := NewBuilder(d, WithTimeout(50*time.Millisecond))
+	defer func() {
+		_ = b.Close()
+	}()
+	if _, err := b.Build(target("im.logic"), newMockConn(), resolver.BuildOptions{}); err == nil {
+		t.Fatal("expected timeout error")
+	}
+	// 超时后创建完成的观察者被关闭
+	close(d.release)
+	select {
+	case <-d.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("watcher created after timeout was not closed")
+	}
+}
+
+// staleDiscovery 的 GetService 在 release 关闭前阻塞, 返回拉取开始时的实例
+type staleDiscovery struct {
+	*memory.Registry
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (d *staleDiscovery) GetService(ctx context.Context, name string) ([]*register.ServiceInstance, error) {
+	ins, err := d.Registry.GetService(ctx, name)
+	close(d.entered)
+	<-d.release
+	return ins, err
+}
+
+func TestResolver_StaleRefresh(t *testing.T) {
+	ctx := context.Background()
+	d := &staleDiscovery{Registry: memory.NewRegistry(), entered: make(chan struct{}), release: make(chan struct{})}
+	_ = d.Register(ctx, &register.ServiceInstance{ID: "1", Name: "im.logic", Endpoints: []string{"grpc://127.0.0.1:9000"}})
+	b := NewBuilder(d)
+	defer func() {
+		_ = b.Close()
+	}()
+	cc := newMockConn()
+	r, err := b.Build(target("im.logic"), cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := cc.wait(t); len(s.Addresses) != 1 {
+		t.Fatalf("unexpected addresses %v", s.Addresses)
+	}
+
+	// 主动刷新拉取到旧快照后, 监听先收到了新实例
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	<-d.entered
+	_ = d.Register(ctx, &register.ServiceInstance{ID: "2", Name: "im.logic", Endpoints: []string{"grpc://127.0.0.1:9001"}})
+	if s := cc.wait(t); len(s.Addresses) != 2 {
+		t.Fatalf("unexpected addresses %v", s.Addresses)
+	}
+	close(d.release)
+	select {
+	case s := <-cc.states:
+		if len(s.Addresses) != 2 {
+			t.Fatalf("stale refresh overwrote newer addresses %v", s.Addresses)
+		}
+	case <-time.After(200 * time.Millisecond):
+	}
 }
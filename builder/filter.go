@@ -0,0 +1,88 @@
+package builder
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/yanglunara/discovery/register"
+)
+
+// filter 根据目标的查询参数过滤实例
+//
+//	discovery:///svc?version=v2&dc=sh&tag=canary&meta.zone=a
+//
+// version 匹配 ServiceInstance.Version, dc 与 meta.<key> 匹配元数据,
+// tag 匹配元数据 tags 中以逗号分隔的标签. 同一参数出现多次时,
+// version、dc、meta 满足其一即可, tag 需要全部包含.
+type filter struct {
+	versions []string
+	tags     []string
+	meta     map[string][]string
+}
+
+func newFilter(query url.Values) *filter {
+	f := &filter{
+		meta: make(map[string][]string),
+	}
+	for key, values := range query {
+		switch {
+		case key == "version":
+			f.versions = values
+		case key == "tag":
+			f.tags = values
+		case key == "dc":
+			f.meta["dc"] = values
+		case strings.HasPrefix(key, "meta.") && len(key) > len("meta."):
+			f.meta[strings.TrimPrefix(key, "meta.")] = values
+		}
+	}
+	return f
+}
+
+func (f *filter) empty() bool {
+	return len(f.versions) == 0 && len(f.tags) == 0 && len(f.meta) == 0
+}
+
+func (f *filter) match(in *register.ServiceInstance) bool {
+	if len(f.versions) > 0 && !contains(f.versions, in.Version) {
+		return false
+	}
+	for key, values := range f.meta {
+		v, ok := in.Metadata[key]
+		if !ok || !contains(values, v) {
+			return false
+		}
+	}
+	if len(f.tags) > 0 {
+		tags := strings.Split(in.Metadata["tags"], ",")
+		for _, tag := range f.tags {
+			if !contains(tags, tag) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// apply 返回满足条件的实例
+func (f *filter) apply(ins []*register.ServiceInstance) []*register.ServiceInstance {
+	if f == nil || f.empty() {
+		return ins
+	}
+	out := make([]*register.ServiceInstance, 0, len(ins))
+	for _, in := range ins {
+		if f.match(in) {
+			out = append(out, in)
+		}
+	}
+	return out
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if strings.TrimSpace(s) == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package builder
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/yanglunara/discovery/register"
+)
+
+func TestFilter(t *testing.T) {
+	ins := []*register.ServiceInstance{
+		{ID: "1", Version: "v1", Metadata: map[string]string{"dc": "sh", "zone": "a"}},
+		{ID: "2", Version: "v2", Metadata: map[string]string{"dc": "sh", "zone": "b", "tags": "canary,gray"}},
+		{ID: "3", Version: "v2", Metadata: map[string]string{"dc": "bj", "zone": "a", "tags": "canary"}},
+		{ID: "4", Version: "v2"},
+	}
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{query: "", want: []string{"1", "2", "3", "4"}},
+		{query: "version=v2", want: []string{"2", "3", "4"}},
+		{query: "version=v1&version=v2&dc=sh", want: []string{"1", "2"}},
+		{query: "tag=canary", want: []string{"2", "3"}},
+		{query: "tag=canary&tag=gray", want: []string{"2"}},
+		{query: "meta.zone=a", want: []string{"1", "3"}},
+		{query: "version=v2&dc=bj&meta.zone=a&tag=canary", want: []string{"3"}},
+		{query: "meta.missing=x", want: []string{}},
+		{query: "unknown=x", want: []string{"1", "2", "3", "4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := newFilter(q).apply(ins)
+			if len(got) != len(tt.want) {
+				t.Fatalf("want %v, got %d instances", tt.want, len(got))
+			}
+			for i, id := range tt.want {
+				if got[i].ID != id {
+					t.Fatalf("want %v, got %s at %d", tt.want, got[i].ID, i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package builder
+
+import (
+	"github.com/yanglunara/discovery/register"
+)
+
+// 实例元数据中的位置键, dc 由 consul 多数据中心查询写入, zone 由 kubernetes 等后端写入
+const (
+	MetadataDC   = "dc"
+	MetadataZone = "zone"
+)
+
+// locality 客户端所在位置, 优先路由到同可用区, 其次同数据中心, 最后全部实例
+type locality struct {
+	dc         string
+	zone       string
+	minHealthy int // 某一层级健康实例数低于该值时降级到下一层级
+}
+
+// apply 按层级选择实例, 注册中心返回的实例视为健康实例
+func (l *locality) apply(ins []*register.ServiceInstance) []*register.ServiceInstance {
+	if l == nil || (l.dc == "" && l.zone == "") {
+		return ins
+	}
+	var sameZone, sameDC []*register.ServiceInstance
+	for _, in := range ins {
+		dc, zone := in.Metadata[MetadataDC], in.Metadata[MetadataZone]
+		// 未配置数据中心时只按可用区匹配. consul 单数据中心与 kubernetes 的实例没有 dc, 视为同一数据中心
+		if l.dc != "" && dc != "" && dc != l.dc {
+			continue
+		}
+		if l.dc != "" {
+			sameDC = append(sameDC, in)
+		}
+		if l.zone != "" && zone == l.zone {
+			sameZone = append(sameZone, in)
+		}
+	}
+	for _, tier := range [][]*register.ServiceInstance{sameZone, sameDC} {
+		if len(tier) > 0 && len(tier) >= l.minHealthy {
+			return tier
+		}
+	}
+	return ins
+}
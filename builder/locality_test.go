@@ -0,0 +1,56 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/yanglunara/discovery/register"
+)
+
+func TestLocality(t *testing.T) {
+	node := func(id, dc, zone string) *register.ServiceInstance {
+		return &register.ServiceInstance{ID: id, Metadata: map[string]string{MetadataDC: dc, MetadataZone: zone}}
+	}
+	ins := []*register.ServiceInstance{
+		node("1", "sh", "a"),
+		node("2", "sh", "a"),
+		node("3", "sh", "b"),
+		node("4", "bj", "a"),
+	}
+	// consul 单数据中心与 kubernetes 的实例只有可用区
+	noDC := []*register.ServiceInstance{
+		node("5", "", "a"),
+		node("6", "", "b"),
+	}
+	tests := []struct {
+		name string
+		l    *locality
+		ins  []*register.ServiceInstance // 为空时使用 ins
+		want []string
+	}{
+		{name: "disabled", l: nil, want: []string{"1", "2", "3", "4"}},
+		{name: "same zone", l: &locality{dc: "sh", zone: "a", minHealthy: 2}, want: []string{"1", "2"}},
+		{name: "zone below threshold", l: &locality{dc: "sh", zone: "a", minHealthy: 3}, want: []string{"1", "2", "3"}},
+		{name: "dc below threshold", l: &locality{dc: "sh", zone: "a", minHealthy: 4}, want: []string{"1", "2", "3", "4"}},
+		{name: "dc only", l: &locality{dc: "bj"}, want: []string{"4"}},
+		{name: "zone only", l: &locality{zone: "a"}, want: []string{"1", "2", "4"}},
+		{name: "no local instances", l: &locality{dc: "gz", zone: "a"}, want: []string{"1", "2", "3", "4"}},
+		{name: "missing dc", l: &locality{dc: "sh", zone: "a"}, ins: noDC, want: []string{"5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := tt.ins
+			if in == nil {
+				in = ins
+			}
+			got := tt.l.apply(in)
+			if len(got) != len(tt.want) {
+				t.Fatalf("want %v, got %d instances", tt.want, len(got))
+			}
+			for i, id := range tt.want {
+				if got[i].ID != id {
+					t.Fatalf("want %v, got %s at %d", tt.want, got[i].ID, i)
+				}
+			}
+		})
+	}
+}
@@ -2,50 +2,112 @@ package builder
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/yanglunara/discovery/register"
+	"github.com/yunbaifan/pkg/logger"
+	"go.uber.org/zap"
 	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
 )
 
+// RawServiceInstance 解析器在每个 resolver.Address 的 BalancerAttributes 中保存原始服务实例使用的键;
+// 每次快照的实例都是新的指针, 放在 Attributes 中会使地址比较失败, 未变化的地址也被重建连接
+const RawServiceInstance = "rawServiceInstance"
+
+// ServiceInstance 从地址的负载均衡属性中取出解析器附加的服务实例, 供负载均衡器读取元数据
+func ServiceInstance(addr resolver.Address) (*register.ServiceInstance, bool) {
+	if addr.BalancerAttributes == nil {
+		return nil, false
+	}
+	in, ok := addr.BalancerAttributes.Value(RawServiceInstance).(*register.ServiceInstance)
+	return in, ok
+}
+
 type discoveryResolver struct {
-	w      register.Watcher
-	cc     resolver.ClientConn
-	d      register.Discovery
-	ctx    context.Context
-	cancel context.CancelFunc
+	w       register.Watcher
+	cc      resolver.ClientConn
+	d       register.Discovery
+	name    string
+	filter  *filter
+	ctx     context.Context
+	cancel  context.CancelFunc
+	builder *Builder
+	once    sync.Once
+	resolve chan struct{} // 立即刷新信号, 多次触发合并为一次
+	seq     atomic.Uint64 // 快照序号, 监听在收到快照时分配, 主动刷新在拉取前分配
+	lock    sync.Mutex    // 串行化监听与主动刷新的地址更新
+	applied uint64        // 最后一次更新的快照序号, 由 lock 保护
 }
 
-func (r *discoveryResolver) ResolveNow(resolver.ResolveNowOptions) {}
+// ResolveNow 触发一次从服务发现的主动拉取
+func (r *discoveryResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolve <- struct{}{}:
+	default:
+	}
+}
 
+// Close 只关闭当前目标的观察者, 服务发现由构建器负责关闭
 func (r *discoveryResolver) Close() {
-	r.cancel()
-	_ = r.d.Close()
+	r.once.Do(func() {
+		r.cancel()
+		_ = r.w.Close()
+		r.builder.remove(r)
+	})
 }
 
-func (r *discoveryResolver) watch() {
+// refresh 处理 ResolveNow, 通过 GetService 拉取最新实例
+func (r *discoveryResolver) refresh() {
 	for {
 		select {
 		case <-r.ctx.Done():
 			return
-		default:
+		case <-r.resolve:
 		}
-		var (
-			ins []*register.ServiceInstance
-			err error
-		)
+		// 拉取期间监听收到的快照序号更大, 拉取结果较旧时被丢弃
+		seq := r.seq.Add(1)
+		ins, err := r.d.GetService(r.ctx, r.name)
+		if err != nil {
+			if r.ctx.Err() == nil {
+				r.cc.ReportError(err)
+			}
+			continue
+		}
+		r.update(seq, ins)
+	}
+}
 
-		if ins, err = r.w.Next(); err != nil {
-			if errors.Is(err, context.Canceled) {
-				time.Sleep(time.Second)
-				continue
+// watch 监听实例变化, 出错时上报给 grpc 并按指数退避重试
+func (r *discoveryResolver) watch() {
+	backoff := r.builder.minBackoff
+	for {
+		if r.ctx.Err() != nil {
+			return
+		}
+		ins, err := r.w.Next()
+		if err != nil {
+			if r.ctx.Err() != nil {
+				return
+			}
+			r.cc.ReportError(err)
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(backoff):
 			}
+			if backoff *= 2; backoff > r.builder.maxBackoff {
+				backoff = r.builder.maxBackoff
+			}
+			continue
 		}
-		r.update(ins)
+		backoff = r.builder.minBackoff
+		r.update(r.seq.Add(1), ins)
 	}
 }
 
@@ -63,7 +125,9 @@ func (r *discoveryResolver) ParseEndpoint(endpoints []string) (string, error) {
 	return "", nil
 }
 
-func (r *discoveryResolver) update(ins []*register.ServiceInstance) {
+// update 按快照序号更新地址, 序号小于已更新快照的结果已过期, 直接丢弃
+func (r *discoveryResolver) update(seq uint64, ins []*register.ServiceInstance) {
+	ins = subset(r.builder.clientID, r.builder.locality.apply(r.filter.apply(ins)), r.builder.subsetSize)
 	var (
 		endpoints = make(map[string]struct{})
 		filtered  = make([]*register.ServiceInstance, 0, len(ins))
@@ -90,16 +154,48 @@ func (r *discoveryResolver) update(ins []*register.ServiceInstance) {
 		ept, _ := r.ParseEndpoint(in.Endpoints)
 		endpoints[ept] = struct{}{}
 		addr := resolver.Address{
-			ServerName: in.Name,
-			Attributes: parseAttributes(in.Metadata).WithValue("rawServiceInstance", in),
-			Addr:       ept,
+			ServerName:         in.Name,
+			Attributes:         parseAttributes(in.Metadata),
+			BalancerAttributes: attributes.New(RawServiceInstance, in),
+			Addr:               ept,
 		}
 		addrs = append(addrs, addr)
 	}
-	if len(addrs) == 0 {
+	// 默认保留上一次可用的地址, 开启 clearOnEmpty 时清空
+	if len(addrs) == 0 && !r.builder.clearOnEmpty {
 		return
 	}
-	if err := r.cc.UpdateState(resolver.State{Addresses: addrs}); err != nil {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if seq < r.applied {
+		return
+	}
+	r.applied = seq
+	state := resolver.State{Addresses: addrs, ServiceConfig: r.serviceConfig(filtered)}
+	if err := r.cc.UpdateState(state); err != nil {
 		fmt.Printf("[resolver] failed to update state: %s \n", err.Error())
 	}
 }
+
+// serviceConfig 返回第一个合法的 service config, 解析失败的配置被跳过, 避免个别实例发布的错误配置下发给所有客户端.
+// 下发后会覆盖客户端通过 grpc.WithDefaultServiceConfig 设置的默认配置
+func (r *discoveryResolver) serviceConfig(ins []*register.ServiceInstance) *serviceconfig.ParseResult {
+	for _, in := range ins {
+		sc := in.Metadata[register.ServiceConfigKey]
+		if sc == "" {
+			continue
+		}
+		res := r.cc.ParseServiceConfig(sc)
+		if res == nil || res.Err != nil {
+			var err error
+			if res != nil {
+				err = res.Err
+			}
+			logger.Logger.Warn("skip invalid service config",
+				zap.String("service", in.Name), zap.String("id", in.ID), zap.Error(err))
+			continue
+		}
+		return res
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package builder
+
+import (
+	"sort"
+
+	"github.com/yanglunara/discovery/lib"
+	"github.com/yanglunara/discovery/register"
+)
+
+// subset 基于 rendezvous hashing 的确定性子集选择:
+// 每个实例按 hash(clientID, 实例) 打分, 取分数最高的 size 个.
+// 同一客户端每次得到相同的子集, 不同客户端的子集均匀分布;
+// 实例增减时只影响进入或离开子集的那一个实例, 其余连接保持不变.
+func subset(clientID string, ins []*register.ServiceInstance, size int) []*register.ServiceInstance {
+	if size <= 0 || len(ins) <= size {
+		return ins
+	}
+	type scored struct {
+		in    *register.ServiceInstance
+		score uint64
+	}
+	items := make([]scored, 0, len(ins))
+	for _, in := range ins {
+		items = append(items, scored{in: in, score: lib.Hash(clientID, instanceKey(in))})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].score > items[j].score
+	})
+	out := make([]*register.ServiceInstance, 0, size)
+	for _, item := range items[:size] {
+		out = append(out, item.in)
+	}
+	return out
+}
+
+// instanceKey 实例的稳定标识, 没有 ID 时使用端点
+func instanceKey(in *register.ServiceInstance) string {
+	if in.ID != "" {
+		return in.ID
+	}
+	if len(in.Endpoints) > 0 {
+		return in.Endpoints[0]
+	}
+	return in.Name
+}
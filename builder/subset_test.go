@@ -0,0 +1,70 @@
+package builder
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/yanglunara/discovery/register"
+)
+
+func instances(n int) []*register.ServiceInstance {
+	ins := make([]*register.ServiceInstance, 0, n)
+	for i := 0; i < n; i++ {
+		ins = append(ins, &register.ServiceInstance{ID: fmt.Sprintf("instance-%d", i)})
+	}
+	return ins
+}
+
+func ids(ins []*register.ServiceInstance) map[string]struct{} {
+	out := make(map[string]struct{}, len(ins))
+	for _, in := range ins {
+		out[in.ID] = struct{}{}
+	}
+	return out
+}
+
+func TestSubset(t *testing.T) {
+	ins := instances(200)
+	if got := subset("client-1", ins[:10], 25); len(got) != 10 {
+		t.Fatalf("expected all instances when below size, got %d", len(got))
+	}
+	if got := subset("client-1", ins, 0); len(got) != 200 {
+		t.Fatalf("expected subsetting disabled, got %d", len(got))
+	}
+
+	// 同一客户端得到稳定的子集, 与实例顺序无关
+	a := ids(subset("client-1", ins, 25))
+	reversed := make([]*register.ServiceInstance, len(ins))
+	for i, in := range ins {
+		reversed[len(ins)-1-i] = in
+	}
+	b := ids(subset("client-1", reversed, 25))
+	if len(a) != 25 || fmt.Sprint(a) != fmt.Sprint(b) {
+		t.Fatalf("expected stable subset, got %v and %v", a, b)
+	}
+
+	// 新增一个实例最多替换子集中的一个实例
+	c := ids(subset("client-1", append(ins, &register.ServiceInstance{ID: "instance-new"}), 25))
+	changed := 0
+	for id := range c {
+		if _, ok := a[id]; !ok {
+			changed++
+		}
+	}
+	if changed > 1 {
+		t.Fatalf("expected at most one replaced instance, got %d", changed)
+	}
+
+	// 1000 个客户端每个连接 25 个实例, 每个实例平均 125 个连接
+	load := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		for _, in := range subset(fmt.Sprintf("client-%d", i), ins, 25) {
+			load[in.ID]++
+		}
+	}
+	for id, n := range load {
+		if n < 60 || n > 190 {
+			t.Fatalf("uneven distribution: %s has %d clients", id, n)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package discover
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/yanglunara/discovery/register"
+)
+
+var (
+	_ register.Discovery = (*Composite)(nil)
+)
+
+// DedupKey 返回实例的去重键, 同一个键只保留第一个出现的实例
+type DedupKey func(in *register.ServiceInstance) []string
+
+// DedupByID 按实例ID去重
+func DedupByID(in *register.ServiceInstance) []string {
+	return []string{in.ID}
+}
+
+// DedupByEndpoint 按端点去重, 任一端点相同即视为同一实例
+func DedupByEndpoint(in *register.ServiceInstance) []string {
+	return in.Endpoints
+}
+
+// CompositeOption 组合服务发现选项
+type CompositeOption func(c *Composite)
+
+// Dedup 设置去重方式, 默认按实例ID去重
+func Dedup(key DedupKey) CompositeOption {
+	return func(c *Composite) {
+		c.dedup = key
+	}
+}
+
+// RetryInterval 设置后端不可用时的重试间隔
+func RetryInterval(d time.Duration) CompositeOption {
+	return func(c *Composite) {
+		c.retry = d
+	}
+}
+
+// StaleTimeout 设置后端持续不可用时保留其实例的时长, 超时后移除该后端的实例, 为 0 时立即移除
+func StaleTimeout(d time.Duration) CompositeOption {
+	return func(c *Composite) {
+		c.stale = d
+	}
+}
+
+// Composite 合并多个服务发现后端, 排在前面的后端优先
+type Composite struct {
+	sources []register.Discovery
+	dedup   DedupKey
+	retry   time.Duration
+	stale   time.Duration
+}
+
+func NewComposite(sources []register.Discovery, opts ...CompositeOption) *Composite {
+	c := &Composite{
+		sources: sources,
+		dedup:   DedupByID,
+		retry:   time.Second,
+		stale:   30 * time.Second,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// GetService 并发查询所有后端, 只要有一个后端成功即返回合并结果
+func (c *Composite) GetService(ctx context.Context, serviceName string) ([]*register.ServiceInstance, error) {
+	var (
+		wg      sync.WaitGroup
+		results = make([][]*register.ServiceInstance, len(c.sources))
+		errs    = make([]error, len(c.sources))
+	)
+	for i, source := range c.sources {
+		wg.Add(1)
+		go func(i int, source register.Discovery) {
+			defer wg.Done()
+			results[i], errs[i] = source.GetService(ctx, serviceName)
+		}(i, source)
+	}
+	wg.Wait()
+	ok := false
+	for _, err := range errs {
+		if err == nil {
+			ok = true
+		}
+	}
+	if !ok && len(c.sources) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return c.merge(results), nil
+}
+
+// Watch 监听所有后端, 创建失败的后端在后台重试
+func (c *Composite) Watch(ctx context.Context, serviceName string) (register.Watcher, error) {
+	w := &compositeWatcher{
+		composite: c,
+		event:     make(chan struct{}, 1),
+		snapshots: make([][]*register.ServiceInstance, len(c.sources)),
+		watchers:  make([]register.Watcher, len(c.sources)),
+	}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	var errs []error
+	for i, source := range c.sources {
+		sw, err := source.Watch(w.ctx, serviceName)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		w.watchers[i] = sw
+	}
+	if len(errs) == len(c.sources) {
+		w.cancel()
+		return nil, errors.Join(errs...)
+	}
+	for i, source := range c.sources {
+		w.wg.Add(1)
+		go w.run(i, source, serviceName)
+	}
+	return w, nil
+}
+
+// Close 关闭所有后端
+func (c *Composite) Close() error {
+	var errs []error
+	for _, source := range c.sources {
+		if err := source.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Composite) merge(results [][]*register.ServiceInstance) []*register.ServiceInstance {
+	var (
+		seen = make(map[string]struct{})
+		out  = make([]*register.ServiceInstance, 0)
+	)
+	for _, ss := range results {
+		for _, in := range ss {
+			keys := c.dedup(in)
+			dup := false
+			for _, k := range keys {
+				if _, ok := seen[k]; ok {
+					dup = true
+					break
+				}
+			}
+			if dup {
+				continue
+			}
+			for _, k := range keys {
+				seen[k] = struct{}{}
+			}
+			out = append(out, in)
+		}
+	}
+	return out
+}
+
+var (
+	_ register.Watcher = (*compositeWatcher)(nil)
+)
+
+type compositeWatcher struct {
+	composite *Composite
+	lock      sync.Mutex
+	watchers  []register.Watcher            // 各后端当前的观察者, 重建时替换
+	snapshots [][]*register.ServiceInstance // 各后端最近一次推送的实例, 后端短暂不可用时保留
+	closed    bool
+	event     chan struct{}
+	wg        sync.WaitGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// run 从单个后端拉取实例, 出错时按重试间隔重新创建观察者
+func (w *compositeWatcher) run(i int, source register.Discovery, serviceName string) {
+	defer w.wg.Done()
+	defer w.closeWatcher(i)
+	var failedAt time.Time // 后端开始不可用的时间, 成功获取实例后重置
+	fail := func() {
+		if failedAt.IsZero() {
+			failedAt = time.Now()
+		}
+		if time.Since(failedAt) >= w.composite.stale {
+			w.update(i, nil)
+		}
+	}
+	for {
+		sw := w.watcher(i)
+		if sw == nil {
+			select {
+			case <-w.ctx.Done():
+				return
+			case <-time.After(w.composite.retry):
+			}
+			var err error
+			if sw, err = source.Watch(w.ctx, serviceName); err != nil {
+				fail()
+				continue
+			}
+			if !w.setWatcher(i, sw) {
+				_ = sw.Close()
+				return
+			}
+		}
+		ss, err := sw.Next()
+		if w.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			w.closeWatcher(i)
+			fail()
+			continue
+		}
+		failedAt = time.Time{}
+		w.update(i, ss)
+	}
+}
+
+// update 更新后端的实例快照并通知 Next, ss 为 nil 表示移除该后端的实例
+func (w *compositeWatcher) update(i int, ss []*register.ServiceInstance) {
+	w.lock.Lock()
+	if ss == nil && w.snapshots[i] == nil {
+		w.lock.Unlock()
+		return
+	}
+	w.snapshots[i] = ss
+	w.lock.Unlock()
+	select {
+	case w.event <- struct{}{}:
+	default:
+	}
+}
+
+func (w *compositeWatcher) watcher(i int) register.Watcher {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.watchers[i]
+}
+
+// setWatcher 保存重建的观察者, 已关闭时返回 false 由调用方关闭
+func (w *compositeWatcher) setWatcher(i int, sw register.Watcher) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return false
+	}
+	w.watchers[i] = sw
+	return true
+}
+
+func (w *compositeWatcher) closeWatcher(i int) {
+	w.lock.Lock()
+	sw := w.watchers[i]
+	w.watchers[i] = nil
+	w.lock.Unlock()
+	if sw != nil {
+		_ = sw.Close()
+	}
+}
+
+func (w *compositeWatcher) Next() ([]*register.ServiceInstance, error) {
+	select {
+	case <-w.ctx.Done():
+		return nil, w.ctx.Err()
+	case <-w.event:
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.composite.merge(w.snapshots), nil
+}
+
+// Close 先关闭各后端的观察者再等待, 后端的 Next 不响应 ctx 时也能返回
+func (w *compositeWatcher) Close() error {
+	w.cancel()
+	w.lock.Lock()
+	w.closed = true
+	watchers := w.watchers
+	w.watchers = make([]register.Watcher, len(watchers))
+	w.lock.Unlock()
+	for _, sw := range watchers {
+		if sw != nil {
+			_ = sw.Close()
+		}
+	}
+	w.wg.Wait()
+	return nil
+}
@@ -2,38 +2,316 @@ package discover
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/yanglunara/discovery/register"
-	"google.golang.org/grpc/resolver"
 )
 
 var (
 	_ register.Discovery = (*Discovery)(nil)
+	_ register.Scoper    = (*Discovery)(nil)
+
+	ErrClosed = errors.New("discovery closed")
 )
 
+// Discovery 服务发现前端, 按服务名缓存任意 register.Discovery 推送的实例
 type Discovery struct {
 	ctx      context.Context
-	watcher  register.Watcher
-	registry map[string][]resolver.State
+	cancel   context.CancelFunc
+	source   register.Discovery
+	lock     sync.Mutex
+	registry map[string]*service // 服务注册表，键为服务名
+	closed   bool
 }
 
-func NewDiscovery(ctx context.Context, watcher register.Watcher) *Discovery {
-	return &Discovery{
-		ctx:     ctx,
-		watcher: watcher,
+func NewDiscovery(ctx context.Context, source register.Discovery) *Discovery {
+	d := &Discovery{
+		source:   source,
+		registry: make(map[string]*service),
 	}
+	d.ctx, d.cancel = context.WithCancel(ctx)
+	return d
 }
 
-// GetService 获取服务实例
+// Scope 为上游的指定作用域创建独立缓存, 上游不支持作用域时返回错误
+func (d *Discovery) Scope(authority string) (register.Discovery, error) {
+	scoper, ok := d.source.(register.Scoper)
+	if !ok {
+		return nil, fmt.Errorf("discovery does not support authority %q", authority)
+	}
+	source, err := scoper.Scope(authority)
+	if err != nil {
+		return nil, err
+	}
+	return NewDiscovery(d.ctx, source), nil
+}
+
+// GetService 获取服务实例, 优先返回缓存快照
 func (d *Discovery) GetService(ctx context.Context, serviceName string) ([]*register.ServiceInstance, error) {
-	return nil, nil
+	d.lock.Lock()
+	if d.closed {
+		d.lock.Unlock()
+		return nil, ErrClosed
+	}
+	set, ok := d.registry[serviceName]
+	d.lock.Unlock()
+	if ok {
+		if ss, ok := set.load(); ok {
+			return ss, nil
+		}
+	}
+	return d.source.GetService(ctx, serviceName)
 }
 
-// Watch 监听服务变化
+// Watch 监听服务变化, 每次调用返回独立的观察者, 同名服务共享同一个上游观察者
 func (d *Discovery) Watch(ctx context.Context, serviceName string) (register.Watcher, error) {
-	return d.watcher, nil
+	w := &watcher{
+		event: make(chan struct{}, 1),
+	}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	ok, err := d.join(serviceName, w)
+	if err != nil {
+		w.cancel()
+		return nil, err
+	}
+	if ok {
+		return w, nil
+	}
+	// 上游 Watch 可能是阻塞的网络调用, 在锁外创建, 避免一个慢后端阻塞其他服务
+	set, err := d.newService(serviceName)
+	if err != nil {
+		w.cancel()
+		return nil, err
+	}
+	d.lock.Lock()
+	if d.closed {
+		d.lock.Unlock()
+		w.cancel()
+		_ = set.Close()
+		return nil, ErrClosed
+	}
+	// 创建期间其他调用可能已经创建了同名服务, 此时复用已有的上游观察者
+	if cur, ok := d.registry[serviceName]; ok && cur.add(w) {
+		d.lock.Unlock()
+		w.set = cur
+		_ = set.Close()
+		return w, nil
+	}
+	d.registry[serviceName] = set
+	set.add(w)
+	w.set = set
+	d.lock.Unlock()
+	go set.run()
+	return w, nil
+}
+
+// join 将观察者加入已有的服务, 已有的上游观察者可能正在关闭, 此时返回 false 由调用方重新创建
+func (d *Discovery) join(serviceName string, w *watcher) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed {
+		return false, ErrClosed
+	}
+	if set, ok := d.registry[serviceName]; ok && set.add(w) {
+		w.set = set
+		return true, nil
+	}
+	return false, nil
 }
 
+func (d *Discovery) newService(serviceName string) (*service, error) {
+	upstream, err := d.source.Watch(d.ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	set := &service{
+		serviceName: serviceName,
+		upstream:    upstream,
+		watcher:     make(map[*watcher]struct{}),
+	}
+	set.ctx, set.cancel = context.WithCancel(d.ctx)
+	set.onClose = func() {
+		d.lock.Lock()
+		if d.registry[serviceName] == set {
+			delete(d.registry, serviceName)
+		}
+		d.lock.Unlock()
+	}
+	return set, nil
+}
+
+// Close 关闭所有观察者及上游服务发现
 func (d *Discovery) Close() error {
-	_ = d.watcher.Close()
+	d.lock.Lock()
+	if d.closed {
+		d.lock.Unlock()
+		return nil
+	}
+	d.closed = true
+	sets := make([]*service, 0, len(d.registry))
+	for _, set := range d.registry {
+		sets = append(sets, set)
+	}
+	d.registry = make(map[string]*service)
+	d.lock.Unlock()
+
+	d.cancel()
+	for _, set := range sets {
+		_ = set.Close()
+	}
+	return d.source.Close()
+}
+
+var (
+	_ register.Stopper = (*service)(nil)
+)
+
+type service struct {
+	serviceName string
+	upstream    register.Watcher
+	ss          []*register.ServiceInstance // 最近一次的服务实例快照
+	err         error                       // 上游最近一次的错误, 收到新快照后清除
+	ready       bool
+	closed      bool
+	watcher     map[*watcher]struct{}
+	lock        sync.RWMutex
+	ctx         context.Context
+	cancel      context.CancelFunc
+	onClose     func()
+	closeOnce   sync.Once
+}
+
+// run 从上游观察者拉取服务实例并广播给所有观察者, 上游出错时同样通知观察者
+func (s *service) run() {
+	for {
+		ss, err := s.upstream.Next()
+		if s.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.fail(err)
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		s.broadcast(ss)
+	}
+}
+
+func (s *service) load() ([]*register.ServiceInstance, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if !s.ready {
+		return nil, false
+	}
+	return append([]*register.ServiceInstance(nil), s.ss...), true
+}
+
+// snapshot 返回观察者看到的状态, 上游最近一次出错时返回该错误
+func (s *service) snapshot() ([]*register.ServiceInstance, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	return append([]*register.ServiceInstance(nil), s.ss...), nil
+}
+
+func (s *service) broadcast(ss []*register.ServiceInstance) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ss = ss
+	s.err = nil
+	s.ready = true
+	s.notify()
+}
+
+// fail 记录上游错误并通知观察者, 缓存的快照仍供 GetService 使用
+func (s *service) fail(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.err = err
+	s.notify()
+}
+
+func (s *service) notify() {
+	for w := range s.watcher {
+		select {
+		case w.event <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *service) add(w *watcher) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false
+	}
+	s.watcher[w] = struct{}{}
+	if s.ready || s.err != nil {
+		w.event <- struct{}{}
+	}
+	return true
+}
+
+func (s *service) remove(w *watcher) {
+	s.lock.Lock()
+	delete(s.watcher, w)
+	empty := len(s.watcher) == 0 && !s.closed
+	if empty {
+		s.closed = true
+	}
+	s.lock.Unlock()
+	// 最后一个观察者关闭时释放上游观察者
+	if empty {
+		_ = s.Close()
+	}
+}
+
+func (s *service) Close() error {
+	s.closeOnce.Do(func() {
+		s.lock.Lock()
+		s.closed = true
+		s.lock.Unlock()
+		s.cancel()
+		s.onClose()
+		_ = s.upstream.Close()
+	})
+	return nil
+}
+
+var (
+	_ register.Watcher = (*watcher)(nil)
+)
+
+type watcher struct {
+	event  chan struct{}
+	set    *service
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (w *watcher) Next() ([]*register.ServiceInstance, error) {
+	select {
+	case <-w.ctx.Done():
+		return nil, w.ctx.Err()
+	case <-w.set.ctx.Done():
+		return nil, w.set.ctx.Err()
+	case <-w.event:
+	}
+	return w.set.snapshot()
+}
+
+func (w *watcher) Close() error {
+	w.cancel()
+	w.set.remove(w)
 	return nil
 }
@@ -0,0 +1,437 @@
+package discover
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yanglunara/discovery/register"
+)
+
+// fakeSource 每个服务名只允许一个上游观察者, 用于验证扇出
+type fakeSource struct {
+	lock    sync.Mutex
+	watches map[string]int
+	events  map[string]chan []*register.ServiceInstance
+	closed  bool
+}
+
+func newFakeSource() *fakeSource {
+	return &fakeSource{
+		watches: make(map[string]int),
+		events:  make(map[string]chan []*register.ServiceInstance),
+	}
+}
+
+func (f *fakeSource) push(name string, ss ...*register.ServiceInstance) {
+	f.lock.Lock()
+	ch := f.events[name]
+	f.lock.Unlock()
+	ch <- ss
+}
+
+func (f *fakeSource) GetService(_ context.Context, serviceName string) ([]*register.ServiceInstance, error) {
+	return []*register.ServiceInstance{{ID: "remote", Name: serviceName}}, nil
+}
+
+func (f *fakeSource) Watch(ctx context.Context, serviceName string) (register.Watcher, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.watches[serviceName]++
+	ch := make(chan []*register.ServiceInstance)
+	f.events[serviceName] = ch
+	w := &fakeWatcher{ch: ch}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	return w, nil
+}
+
+func (f *fakeSource) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+	return nil
+}
+
+type fakeWatcher struct {
+	ch     chan []*register.ServiceInstance
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (w *fakeWatcher) Next() ([]*register.ServiceInstance, error) {
+	select {
+	case <-w.ctx.Done():
+		return nil, w.ctx.Err()
+	case ss := <-w.ch:
+		return ss, nil
+	}
+}
+
+func (w *fakeWatcher) Close() error {
+	w.cancel()
+	return nil
+}
+
+func nextWithTimeout(t *testing.T, w register.Watcher) []*register.ServiceInstance {
+	t.Helper()
+	type result struct {
+		ss  []*register.ServiceInstance
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		ss, err := w.Next()
+		ch <- result{ss, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatalf("next failed: %v", r.err)
+		}
+		return r.ss
+	case <-time.After(3 * time.Second):
+		t.Fatal("next timeout")
+	}
+	return nil
+}
+
+func TestDiscovery_Watch(t *testing.T) {
+	ctx := context.Background()
+	src := newFakeSource()
+	d := NewDiscovery(ctx, src)
+
+	// 未缓存时回退到上游
+	if ss, err := d.GetService(ctx, "helloworld"); err != nil || len(ss) != 1 || ss[0].ID != "remote" {
+		t.Fatalf("expected fallback to source, got %v, %v", ss, err)
+	}
+
+	w1, err := d.Watch(ctx, "helloworld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w2, err := d.Watch(ctx, "helloworld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := d.Watch(ctx, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.watches["helloworld"] != 1 || src.watches["other"] != 1 {
+		t.Fatalf("expected one upstream watcher per service, got %v", src.watches)
+	}
+
+	src.push("helloworld", &register.ServiceInstance{ID: "1", Name: "helloworld"})
+	for _, w := range []register.Watcher{w1, w2} {
+		if ss := nextWithTimeout(t, w); len(ss) != 1 || ss[0].ID != "1" {
+			t.Fatalf("unexpected instances %v", ss)
+		}
+	}
+	if ss, err := d.GetService(ctx, "helloworld"); err != nil || len(ss) != 1 || ss[0].ID != "1" {
+		t.Fatalf("expected cached snapshot, got %v, %v", ss, err)
+	}
+
+	// 新的观察者立即收到缓存快照
+	w3, err := d.Watch(ctx, "helloworld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss := nextWithTimeout(t, w3); len(ss) != 1 {
+		t.Fatalf("expected cached snapshot, got %v", ss)
+	}
+
+	src.push("other", &register.ServiceInstance{ID: "2", Name: "other"}, &register.ServiceInstance{ID: "3", Name: "other"})
+	if ss := nextWithTimeout(t, other); len(ss) != 2 {
+		t.Fatalf("unexpected instances %v", ss)
+	}
+
+	// 所有观察者关闭后释放上游, 再次监听时重新创建
+	for _, w := range []register.Watcher{w1, w2, w3} {
+		_ = w.Close()
+	}
+	if _, err = d.Watch(ctx, "helloworld"); err != nil {
+		t.Fatal(err)
+	}
+	if src.watches["helloworld"] != 2 {
+		t.Fatalf("expected upstream watcher to be recreated, got %d", src.watches["helloworld"])
+	}
+
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !src.closed {
+		t.Fatal("expected source to be closed")
+	}
+	if _, err = other.Next(); err == nil {
+		t.Fatal("expected error after close")
+	}
+	if _, err = d.Watch(ctx, "helloworld"); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+// slowSource 指定服务的上游 Watch 阻塞到 release 关闭
+type slowSource struct {
+	*fakeSource
+	slow    string
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *slowSource) Watch(ctx context.Context, serviceName string) (register.Watcher, error) {
+	if serviceName == s.slow {
+		close(s.entered)
+		<-s.release
+	}
+	return s.fakeSource.Watch(ctx, serviceName)
+}
+
+func TestDiscovery_SlowUpstream(t *testing.T) {
+	ctx := context.Background()
+	src := &slowSource{fakeSource: newFakeSource(), slow: "slow", entered: make(chan struct{}), release: make(chan struct{})}
+	d := NewDiscovery(ctx, src)
+	defer func() {
+		_ = d.Close()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.Watch(ctx, "slow")
+		done <- err
+	}()
+	<-src.entered
+	release := sync.OnceFunc(func() {
+		close(src.release)
+	})
+	defer release()
+	fast := make(chan error, 1)
+	go func() {
+		_, err := d.Watch(ctx, "fast")
+		fast <- err
+	}()
+	// 慢后端的上游 Watch 不能阻塞其他服务
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("watch blocked by slow upstream")
+	}
+	release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// downSource 模拟不可用的后端
+type downSource struct{}
+
+func (downSource) GetService(context.Context, string) ([]*register.ServiceInstance, error) {
+	return nil, ErrClosed
+}
+
+func (downSource) Watch(context.Context, string) (register.Watcher, error) {
+	return nil, ErrClosed
+}
+
+func (downSource) Close() error {
+	return nil
+}
+
+func TestComposite(t *testing.T) {
+	ctx := context.Background()
+	consul, k8s := newFakeSource(), newFakeSource()
+	tests := []struct {
+		name  string
+		dedup DedupKey
+		want  []string
+	}{
+		{name: "by id", dedup: DedupByID, want: []string{"1", "2", "3"}},
+		{name: "by endpoint", dedup: DedupByEndpoint, want: []string{"1", "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewComposite([]register.Discovery{consul, downSource{}, k8s}, Dedup(tt.dedup), RetryInterval(10*time.Millisecond))
+			w, err := c.Watch(ctx, "helloworld")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = w.Close()
+			}()
+			consul.push("helloworld",
+				&register.ServiceInstance{ID: "1", Endpoints: []string{"grpc://10.0.0.1:9000"}},
+				&register.ServiceInstance{ID: "2", Endpoints: []string{"grpc://10.0.0.2:9000"}},
+			)
+			if ss := nextWithTimeout(t, w); len(ss) != 2 {
+				t.Fatalf("unexpected instances %v", ss)
+			}
+			// 同一实例同时注册在两个后端
+			k8s.push("helloworld",
+				&register.ServiceInstance{ID: "2", Endpoints: []string{"grpc://10.0.0.2:9000"}},
+				&register.ServiceInstance{ID: "3", Endpoints: []string{"grpc://10.0.0.1:9000"}},
+			)
+			ss := nextWithTimeout(t, w)
+			if len(ss) != len(tt.want) {
+				t.Fatalf("want %v, got %v", tt.want, ss)
+			}
+			for i, id := range tt.want {
+				if ss[i].ID != id {
+					t.Fatalf("want %v, got %v", tt.want, ss)
+				}
+			}
+		})
+	}
+
+	c := NewComposite([]register.Discovery{downSource{}, consul})
+	if ss, err := c.GetService(ctx, "helloworld"); err != nil || len(ss) != 1 {
+		t.Fatalf("expected result from healthy backend, got %v, %v", ss, err)
+	}
+	c = NewComposite([]register.Discovery{downSource{}})
+	if _, err := c.Watch(ctx, "helloworld"); err == nil {
+		t.Fatal("expected error when all backends are down")
+	}
+}
+
+// brokenSource 首次 Watch 推送一次实例, broken 关闭后观察者出错且无法重建
+type brokenSource struct {
+	downSource
+	ss      []*register.ServiceInstance
+	broken  chan struct{}
+	watched atomic.Bool
+}
+
+func (b *brokenSource) Watch(context.Context, string) (register.Watcher, error) {
+	if b.watched.Swap(true) {
+		return nil, ErrClosed
+	}
+	return &brokenWatcher{source: b}, nil
+}
+
+type brokenWatcher struct {
+	source *brokenSource
+	pushed bool
+}
+
+func (w *brokenWatcher) Next() ([]*register.ServiceInstance, error) {
+	if !w.pushed {
+		w.pushed = true
+		return w.source.ss, nil
+	}
+	<-w.source.broken
+	return nil, ErrClosed
+}
+
+func (w *brokenWatcher) Close() error {
+	return nil
+}
+
+// blockingWatcher 的 Next 忽略 ctx, 只在 Close 后返回
+type blockingWatcher struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (w *blockingWatcher) Next() ([]*register.ServiceInstance, error) {
+	<-w.closed
+	return nil, ErrClosed
+}
+
+func (w *blockingWatcher) Close() error {
+	w.once.Do(func() {
+		close(w.closed)
+	})
+	return nil
+}
+
+type blockingSource struct {
+	downSource
+}
+
+func (blockingSource) Watch(context.Context, string) (register.Watcher, error) {
+	return &blockingWatcher{closed: make(chan struct{})}, nil
+}
+
+func TestComposite_Stale(t *testing.T) {
+	ctx := context.Background()
+	consul := newFakeSource()
+	broken := &brokenSource{
+		ss:     []*register.ServiceInstance{{ID: "2"}},
+		broken: make(chan struct{}),
+	}
+	c := NewComposite([]register.Discovery{consul, broken}, RetryInterval(10*time.Millisecond), StaleTimeout(50*time.Millisecond))
+	w, err := c.Watch(ctx, "helloworld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = w.Close()
+	}()
+	consul.push("helloworld", &register.ServiceInstance{ID: "1"})
+	// 等待两个后端的实例都已合并
+	for len(nextWithTimeout(t, w)) != 2 {
+	}
+
+	// 后端持续不可用超过 StaleTimeout 后移除其实例
+	close(broken.broken)
+	if ss := nextWithTimeout(t, w); len(ss) != 1 || ss[0].ID != "1" {
+		t.Fatalf("expected stale instances removed, got %v", ss)
+	}
+}
+
+func TestComposite_CloseBlockingBackend(t *testing.T) {
+	c := NewComposite([]register.Discovery{blockingSource{}})
+	w, err := c.Watch(context.Background(), "helloworld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = w.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("close blocked by backend watcher")
+	}
+}
+
+func TestDiscovery_UpstreamError(t *testing.T) {
+	ctx := context.Background()
+	src := &brokenSource{ss: []*register.ServiceInstance{{ID: "1", Name: "helloworld"}}, broken: make(chan struct{})}
+	d := NewDiscovery(ctx, src)
+	defer func() {
+		_ = d.Close()
+	}()
+	w, err := d.Watch(ctx, "helloworld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss := nextWithTimeout(t, w); len(ss) != 1 {
+		t.Fatalf("unexpected instances %v", ss)
+	}
+
+	// 上游出错时观察者收到错误, GetService 仍返回缓存快照
+	close(src.broken)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := w.Next()
+		errCh <- err
+	}()
+	select {
+	case err = <-errCh:
+		if !errors.Is(err, ErrClosed) {
+			t.Fatalf("err = %v, want %v", err, ErrClosed)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("upstream error not forwarded")
+	}
+	if ss, err := d.GetService(ctx, "helloworld"); err != nil || len(ss) != 1 {
+		t.Fatalf("expected cached snapshot, got %v, %v", ss, err)
+	}
+}
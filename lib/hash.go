@@ -0,0 +1,21 @@
+package lib
+
+import "hash/fnv"
+
+// Hash 计算以 0 分隔的 parts 的 fnv 哈希, 再经 splitmix64 混合, 使相近的字符串均匀分布
+func Hash(parts ...string) uint64 {
+	h := fnv.New64a()
+	for i, p := range parts {
+		if i > 0 {
+			_, _ = h.Write([]byte{0})
+		}
+		_, _ = h.Write([]byte(p))
+	}
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,13 @@
+package lib
+
+import "testing"
+
+func TestHash(t *testing.T) {
+	if Hash("a", "b") != Hash("a", "b") {
+		t.Fatal("expected stable hash")
+	}
+	// 分隔符区分不同的拆分方式
+	if Hash("a", "b") == Hash("ab") || Hash("ab", "c") == Hash("a", "bc") {
+		t.Fatal("expected parts to be separated")
+	}
+}
@@ -18,17 +18,14 @@ func Extract(hostPath string, lis net.Listener) (string, error) {
 			return "", fmt.Errorf("fialed to format port :%v ", lis.Addr())
 		}
 	}
+	// 监听的是具体地址时直接使用, 未指定地址时从网卡中选择
 	checkAddr := func(addr string) bool {
-		var (
-			count int = 1
-		)
 		for _, ip := range []string{"0.0.0.0", "[::]", "::"} {
 			if addr == ip {
-				continue
+				return false
 			}
-			count++
 		}
-		return count == 3
+		return true
 	}
 	if len(addr) > 0 && checkAddr(addr) {
 		return net.JoinHostPort(addr, port), nil
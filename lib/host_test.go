@@ -0,0 +1,48 @@
+package lib
+
+import (
+	"net"
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+
+	// 具体地址原样使用, 端口取自监听器
+	host, err := Extract("127.0.0.1:0", lis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != net.JoinHostPort("127.0.0.1", port) {
+		t.Fatalf("host = %s, want 127.0.0.1:%s", host, port)
+	}
+	if host, _ = Extract("10.0.0.5:9000", nil); host != "10.0.0.5:9000" {
+		t.Fatalf("host = %s, want 10.0.0.5:9000", host)
+	}
+	if host, _ = Extract("[::1]:9000", nil); host != "[::1]:9000" {
+		t.Fatalf("host = %s, want [::1]:9000", host)
+	}
+
+	// 未指定地址时不能对外公布 0.0.0.0, 从网卡中选择, 没有可用网卡时返回空
+	for _, addr := range []string{"0.0.0.0:9000", "[::]:9000", ":9000"} {
+		host, err = Extract(addr, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if host == "" {
+			continue
+		}
+		h, p, err := net.SplitHostPort(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip := net.ParseIP(h); ip == nil || ip.IsUnspecified() || p != "9000" {
+			t.Fatalf("Extract(%s) = %s", addr, host)
+		}
+	}
+}
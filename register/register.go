@@ -2,8 +2,6 @@ package register
 
 import (
 	"context"
-
-	consulApi "github.com/hashicorp/consul/api"
 )
 
 // ServiceInstance 服务实例
@@ -17,6 +15,9 @@ type ServiceInstance struct {
 	LastTs int64 `json:"latest_timestamp"`
 }
 
+// ServiceConfigKey 元数据中保存 grpc service config(JSON) 的键, 解析器会将其下发给客户端
+const ServiceConfigKey = "grpc_service_config"
+
 // Registrar 注册器接口
 type Registrar interface {
 	// 注册服务
@@ -35,6 +36,13 @@ type Discovery interface {
 	Close() error
 }
 
+// Scoper 支持按作用域查询的服务发现, 作用域由 discovery://<authority>/svc 中的 authority 指定,
+// 例如 consul 的数据中心、命名空间或分区, etcd 的命名空间
+type Scoper interface {
+	// 返回指定作用域的服务发现, 关闭它不影响原始的服务发现
+	Scope(authority string) (Discovery, error)
+}
+
 // Watcher  观察者接口
 type Watcher interface {
 	Next() ([]*ServiceInstance, error) // 获取下一个服务实例
@@ -42,9 +50,9 @@ type Watcher interface {
 }
 
 // Builder 构建器接口
-type Builder interface {
-	Build(id string) Resolver // 构建解析器
-	Scheme() string           // 获取方案
+type Builder[T any] interface {
+	Build(id string) Resolver[T] // 构建解析器
+	Scheme() string              // 获取方案
 }
 
 // Stopper 停止器接口
@@ -52,28 +60,7 @@ type Stopper interface {
 	Close() error // 关闭停止器
 }
 
-// Resolver 解析器接口
-type Resolver interface {
-	ServiceResolver(ctx context.Context, entries []*consulApi.ServiceEntry) []*ServiceInstance // 服务解析
-}
-
-// 数据中心类型
-const (
-	SingleDataCenter = "SINGLE" // 单数据中心
-	MultiDataCenter  = "MULTI"  // 多数据中心
-)
-
-// EntriesOption 条目选项
-type EntriesOption struct {
-	Resolver
-	Service, Tag string
-	Index        uint64
-	PassingOnly  bool
-	Opts         *consulApi.QueryOptions
-}
-
-// Entries 条目接口
-type Entries interface {
-	MultiDCService(ctx context.Context, en *EntriesOption) ([]*ServiceInstance, uint64, error)  // 多数据中心服务
-	SingleDCEntries(ctx context.Context, en *EntriesOption) ([]*ServiceInstance, uint64, error) // 单数据中心条目
+// Resolver 解析器接口, T 为注册中心返回的原始条目类型
+type Resolver[T any] interface {
+	ServiceResolver(ctx context.Context, entries []T) []*ServiceInstance // 服务解析
 }
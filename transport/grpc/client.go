@@ -2,21 +2,42 @@ package grpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
+	_ "github.com/yanglunara/discovery/balancer/p2c"
+	"github.com/yanglunara/discovery/balancer/ringhash"
+	_ "github.com/yanglunara/discovery/balancer/wrr"
 	"github.com/yanglunara/discovery/builder"
 	"github.com/yanglunara/discovery/register"
+	"github.com/yanglunara/discovery/transport"
+	mid "github.com/yanglunara/discovery/transport/middleware"
 	"google.golang.org/grpc"
 	grpcinsecure "google.golang.org/grpc/credentials/insecure"
+	grpcmd "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 )
 
 type (
 	Conn interface {
+		// GetConn 获取服务的连接, 相同服务且没有额外 DialOption 时复用缓存的连接并增加引用计数
 		GetConn(ctx context.Context, serviceName string, opts ...grpc.DialOption) (*grpc.ClientConn, error)
+		// Release 释放 GetConn 返回的连接, 引用计数归零时关闭连接
+		Release(conn *grpc.ClientConn) error
+		// Close 关闭所有连接与服务发现
+		Close() error
 	}
 )
+
+// ErrClientClosed 客户端已关闭
+var ErrClientClosed = errors.New("grpc client closed")
+
 type ClientOption func(o *rpcClient)
 
 func WithDiscoveryAddress(addres string) ClientOption {
@@ -29,15 +50,69 @@ func WithOptions(opts ...grpc.DialOption) ClientOption {
 		o.grpcOpts = opts
 	}
 }
+
+// WithEendpoint 设置默认服务, GetConn 的服务名为空时使用
 func WithEendpoint(endpoint string) ClientOption {
 	return func(o *rpcClient) {
 		o.endpoint = fmt.Sprintf("discovery:///%s", endpoint)
 	}
 }
 
+// WithBalancerName 设置负载均衡器, 默认 round_robin,
+// 可选 wrr.Name(discovery_weighted)、p2c.Name(discovery_p2c)、ringhash.Name(discovery_ring_hash)
+// 或其他已注册的负载均衡器
+func WithBalancerName(name string) ClientOption {
+	return func(o *rpcClient) {
+		o.balancerName = name
+	}
+}
+
+// WithSubsetSize 设置确定性子集大小, 小于等于 0 时连接所有实例;
+// 使用 ringhash.Name 时不选择子集, 保证所有客户端的哈希环一致
+func WithSubsetSize(size int) ClientOption {
+	return func(o *rpcClient) {
+		o.subsetSize = size
+	}
+}
+
+// WithClientID 设置选择子集使用的客户端标识, 默认为主机名
+func WithClientID(id string) ClientOption {
+	return func(o *rpcClient) {
+		o.clientID = id
+	}
+}
+
+// WithLocality 设置客户端所在的数据中心与可用区, 本地健康实例数低于 minHealthy 时才访问远端实例
+func WithLocality(dc, zone string, minHealthy int) ClientOption {
+	return func(o *rpcClient) {
+		o.dc, o.zone, o.minHealthy = dc, zone, minHealthy
+	}
+}
+
 func WithInsecure(insecure bool) ClientOption {
 	return func(o *rpcClient) {
-		o.insecure = true
+		o.insecure = insecure
+	}
+}
+
+// WithMiddleware 设置所有方法使用的客户端中间件
+func WithMiddleware(m ...mid.Middleware) ClientOption {
+	return func(o *rpcClient) {
+		o.middleware.Use(m...)
+	}
+}
+
+// WithSelectorMiddleware 为匹配 selector 的方法设置客户端中间件, selector 以 * 结尾时按前缀匹配
+func WithSelectorMiddleware(selector string, m ...mid.Middleware) ClientOption {
+	return func(o *rpcClient) {
+		o.middleware.Add(selector, m...)
+	}
+}
+
+// WithDiscovery 设置服务发现, 设置后不再根据 WithDiscoveryAddress 创建 consul 服务发现
+func WithDiscovery(d register.Discovery) ClientOption {
+	return func(o *rpcClient) {
+		o.discovery = d
 	}
 }
 
@@ -51,6 +126,10 @@ type rpcClient struct {
 	timeout                time.Duration
 	balancerName           string
 	subsetSize             int
+	clientID               string
+	dc                     string // 客户端所在数据中心
+	zone                   string // 客户端所在可用区
+	minHealthy             int
 	printDiscoveryDebugLog bool
 	healthCheckConfig      string
 	discovery              register.Discovery // 服务发现
@@ -60,7 +139,19 @@ type rpcClient struct {
 	WindowSize             int32
 	aliveTime              time.Duration
 	insecure               bool
-	localCache             map[string]*grpc.ClientConn
+	builder                *builder.Builder // 所有连接共用的解析器构建器
+	middleware             transport.Matcher
+	lock                   sync.Mutex
+	localCache             map[string]*cachedConn           // 目标 -> 共享连接
+	conns                  map[*grpc.ClientConn]*cachedConn // 所有未关闭的连接
+	closed                 bool
+}
+
+// cachedConn 带引用计数的连接
+type cachedConn struct {
+	target string // 共享连接的缓存键, 独占连接为空
+	conn   *grpc.ClientConn
+	refs   int
 }
 
 // SetRPCClient 设置RPC客户端 单列模式
@@ -69,25 +160,45 @@ func SetRPCClient(opt ...ClientOption) Conn {
 		mu.Lock()
 		defer mu.Unlock()
 		if RpcClient == nil {
-			gcs := rpcClient{
-				timeout:                3 * time.Second,
-				balancerName:           "round_robin",
-				subsetSize:             25,
-				printDiscoveryDebugLog: true,
-				healthCheckConfig:      `,"healthCheckConfig":{"serviceName":""}`,
-				WindowSize:             1 << 24,
-				aliveTime:              10 * time.Second,
-				localCache:             make(map[string]*grpc.ClientConn),
-			}
-			for _, o := range opt {
-				o(&gcs)
-			}
-			gcs.discovery = builder.NewConsulDiscovery(gcs.address)
+			RpcClient = NewRPCClient(opt...)
 		}
 	}
 	return RpcClient
 }
 
+// NewRPCClient 创建RPC客户端, 未设置 WithDiscovery 时使用 WithDiscoveryAddress 指定的 consul
+func NewRPCClient(opt ...ClientOption) Conn {
+	gcs := &rpcClient{
+		timeout:                3 * time.Second,
+		balancerName:           "round_robin",
+		subsetSize:             25,
+		printDiscoveryDebugLog: true,
+		healthCheckConfig:      `,"healthCheckConfig":{"serviceName":""}`,
+		WindowSize:             1 << 24,
+		aliveTime:              10 * time.Second,
+		localCache:             make(map[string]*cachedConn),
+		conns:                  make(map[*grpc.ClientConn]*cachedConn),
+		middleware:             transport.NewMatcher(),
+	}
+	gcs.clientID, _ = os.Hostname()
+	for _, o := range opt {
+		o(gcs)
+	}
+	if gcs.discovery == nil {
+		gcs.discovery = builder.NewConsulDiscovery(gcs.address)
+	}
+	subsetSize := gcs.subsetSize
+	if gcs.balancerName == ringhash.Name {
+		// 各客户端的子集不同时, 相同哈希键会落到不同实例
+		subsetSize = 0
+	}
+	gcs.builder = builder.NewBuilder(gcs.discovery,
+		builder.WithSubset(gcs.clientID, subsetSize),
+		builder.WithLocality(gcs.dc, gcs.zone, gcs.minHealthy),
+	)
+	return gcs
+}
+
 func (g *rpcClient) setGrpcOpts() []grpc.DialOption {
 	grpcOpts := []grpc.DialOption{
 		grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingConfig": [{"%s":{}}]%s}`,
@@ -96,21 +207,257 @@ func (g *rpcClient) setGrpcOpts() []grpc.DialOption {
 		grpc.WithInitialConnWindowSize(g.WindowSize),
 		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(int(g.WindowSize))),
 		grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(int(g.WindowSize))),
+		grpc.WithChainUnaryInterceptor(g.UnaryClientInterceptor()),
+		grpc.WithChainStreamInterceptor(g.StreamClientInterceptor()),
 	}
 	if g.insecure {
 		grpcOpts = append(grpcOpts, grpc.WithTransportCredentials(grpcinsecure.NewCredentials()))
 	}
-	if g.discovery != nil {
-		grpcOpts = append(grpcOpts, grpc.WithResolvers(
-			builder.NewBuilder(g.discovery),
-		))
-	}
+	grpcOpts = append(grpcOpts, grpc.WithResolvers(g.builder))
 	if len(g.grpcOpts) > 0 {
 		grpcOpts = append(grpcOpts, g.grpcOpts...)
 	}
 	return grpcOpts
 }
 
+// target 服务名为空时使用 WithEendpoint 设置的服务, 已是完整目标(如 discovery://sh/svc?version=v2)时原样使用
+func (g *rpcClient) target(serviceName string) string {
+	switch {
+	case serviceName == "":
+		return g.endpoint
+	case strings.Contains(serviceName, "://"):
+		return serviceName
+	}
+	return fmt.Sprintf("discovery:///%s", serviceName)
+}
+
 func (g *rpcClient) GetConn(ctx context.Context, serviceName string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
-	return grpc.DialContext(ctx, fmt.Sprintf("discovery:///%s", serviceName), g.setGrpcOpts()...)
+	target := g.target(serviceName)
+	if target == "" {
+		return nil, errors.New("grpc client: empty service name")
+	}
+	g.lock.Lock()
+	if g.closed {
+		g.lock.Unlock()
+		return nil, ErrClientClosed
+	}
+	// 带额外 DialOption 的调用使用独占连接, 不与其他调用共享
+	if len(opts) == 0 {
+		if c, ok := g.localCache[target]; ok {
+			c.refs++
+			g.lock.Unlock()
+			return c.conn, nil
+		}
+	}
+	g.lock.Unlock()
+
+	conn, err := grpc.DialContext(ctx, target, append(g.setGrpcOpts(), opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.closed {
+		_ = conn.Close()
+		return nil, ErrClientClosed
+	}
+	if len(opts) == 0 {
+		// 并发创建时保留先创建的连接
+		if c, ok := g.localCache[target]; ok {
+			c.refs++
+			_ = conn.Close()
+			return c.conn, nil
+		}
+		c := &cachedConn{target: target, conn: conn, refs: 1}
+		g.localCache[target] = c
+		g.conns[conn] = c
+		return conn, nil
+	}
+	g.conns[conn] = &cachedConn{conn: conn, refs: 1}
+	return conn, nil
+}
+
+func (g *rpcClient) Release(conn *grpc.ClientConn) error {
+	g.lock.Lock()
+	c, ok := g.conns[conn]
+	if !ok {
+		g.lock.Unlock()
+		return nil
+	}
+	if c.refs--; c.refs > 0 {
+		g.lock.Unlock()
+		return nil
+	}
+	delete(g.conns, conn)
+	if c.target != "" {
+		delete(g.localCache, c.target)
+	}
+	g.lock.Unlock()
+	return conn.Close()
+}
+
+// Close 关闭所有连接, 再通过构建器关闭解析器与服务发现
+func (g *rpcClient) Close() error {
+	g.lock.Lock()
+	if g.closed {
+		g.lock.Unlock()
+		return nil
+	}
+	g.closed = true
+	conns := g.conns
+	g.conns = make(map[*grpc.ClientConn]*cachedConn)
+	g.localCache = make(map[string]*cachedConn)
+	g.lock.Unlock()
+	var errs []error
+	for conn := range conns {
+		if err := conn.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := g.builder.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// newClientTransport 创建客户端 Transport, 请求头初始为 outgoing metadata 的副本,
+// endpoint 在选定实例前为连接目标, 调用后更新为实际访问的实例地址
+func newClientTransport(ctx context.Context, cc *grpc.ClientConn, method string) *Transport {
+	md, _ := grpcmd.FromOutgoingContext(ctx)
+	return &Transport{
+		endpoint:   cc.Target(),
+		operation:  method,
+		reqHeader:  headerMetadata(md.Copy()),
+		respHeader: headerMetadata{},
+	}
+}
+
+// UnaryClientInterceptor 创建客户端 Transport 并执行按方法匹配的中间件,
+// 中间件写入的请求头随请求发送, 响应的 header 与 trailer 写回 Transport
+func (g *rpcClient) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		base, _ := grpcmd.FromOutgoingContext(ctx)
+		tr := newClientTransport(ctx, cc, method)
+		ctx = transport.NewClientContext(ctx, tr)
+		h := func(ctx context.Context, req interface{}) (interface{}, error) {
+			var (
+				header, trailer grpcmd.MD
+				p               peer.Peer
+			)
+			ctx = outgoingContext(ctx, base, tr.reqHeader)
+			err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Header(&header), grpc.Trailer(&trailer), grpc.Peer(&p))...)
+			if p.Addr != nil {
+				tr.endpoint = peerEndpoint(&p)
+			}
+			copyMetadata(tr.respHeader, header)
+			copyMetadata(tr.respHeader, trailer)
+			return reply, err
+		}
+		if next := g.middleware.Match(tr.Operation()); len(next) > 0 {
+			h = mid.Next(next...)(h)
+		}
+		_, err := h(ctx, req)
+		return err
+	}
+}
+
+// StreamClientInterceptor 创建客户端 Transport, 中间件包裹流的创建;
+// 实例地址与响应 header 在首次收到响应时写回, trailer 在流结束时写回
+func (g *rpcClient) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		base, _ := grpcmd.FromOutgoingContext(ctx)
+		tr := newClientTransport(ctx, cc, method)
+		ctx = transport.NewClientContext(ctx, tr)
+		h := func(ctx context.Context, _ interface{}) (interface{}, error) {
+			stream, err := streamer(outgoingContext(ctx, base, tr.reqHeader), desc, cc, method, opts...)
+			if err != nil {
+				return nil, err
+			}
+			return &clientStream{ClientStream: stream, tr: tr}, nil
+		}
+		if next := g.middleware.Match(tr.Operation()); len(next) > 0 {
+			h = mid.Next(next...)(h)
+		}
+		stream, err := h(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		return stream.(grpc.ClientStream), nil
+	}
+}
+
+// outgoingContext 以 Transport 请求头作为 outgoing metadata, 并保留中间件通过
+// metadata.AppendToOutgoingContext 追加的值; base 为创建 Transport 时的 outgoing metadata,
+// 已包含在请求头中, 不再重复发送
+func outgoingContext(ctx context.Context, base grpcmd.MD, header headerMetadata) context.Context {
+	md := grpcmd.MD(header).Copy()
+	cur, _ := grpcmd.FromOutgoingContext(ctx)
+	for k, v := range cur {
+		if prev := base[k]; len(v) >= len(prev) && slices.Equal(v[:len(prev)], prev) {
+			v = v[len(prev):]
+		}
+		if len(v) > 0 {
+			md[k] = append(md[k], v...)
+		}
+	}
+	return grpcmd.NewOutgoingContext(ctx, md)
+}
+
+// clientStream 将流的响应 header 与 trailer 写回 Transport, 收到响应后更新实际访问的实例地址;
+// 创建流后不能立即调用 Context, 否则流被提交, 不再进行透明重试与 retryPolicy 重试
+type clientStream struct {
+	grpc.ClientStream
+	tr       *Transport
+	header   sync.Once
+	trailer  sync.Once
+	endpoint sync.Once
+}
+
+func (s *clientStream) Header() (grpcmd.MD, error) {
+	md, err := s.ClientStream.Header()
+	if err == nil {
+		s.peer()
+		s.header.Do(func() {
+			copyMetadata(s.tr.respHeader, md)
+		})
+	}
+	return md, err
+}
+
+func (s *clientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	s.peer()
+	if err != nil {
+		// 流结束后每次 RecvMsg 都会返回错误, trailer 只写回一次
+		s.trailer.Do(func() {
+			copyMetadata(s.tr.respHeader, s.ClientStream.Trailer())
+		})
+		return err
+	}
+	s.header.Do(func() {
+		if md, err := s.ClientStream.Header(); err == nil {
+			copyMetadata(s.tr.respHeader, md)
+		}
+	})
+	return nil
+}
+
+// peer 收到响应后流已提交, 此时读取实际访问的实例地址
+func (s *clientStream) peer() {
+	s.endpoint.Do(func() {
+		if p, ok := peer.FromContext(s.ClientStream.Context()); ok {
+			s.tr.endpoint = peerEndpoint(p)
+		}
+	})
+}
+
+// peerEndpoint 实际访问的实例地址, 与注册的 grpc 端点格式一致
+func peerEndpoint(p *peer.Peer) string {
+	return (&url.URL{Scheme: string(transport.SchemeGRPC), Host: p.Addr.String()}).String()
+}
+
+func copyMetadata(dst headerMetadata, src grpcmd.MD) {
+	for k, v := range src {
+		dst[k] = append(dst[k], v...)
+	}
 }
@@ -0,0 +1,412 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yanglunara/discovery/balancer/ringhash"
+	"github.com/yanglunara/discovery/register"
+	"github.com/yanglunara/discovery/transport"
+	mid "github.com/yanglunara/discovery/transport/middleware"
+	"github.com/yanglunara/discovery/watcher/memory"
+	"github.com/yunbaifan/pkg/logger"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	grpcmd "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	logger.Logger = zap.NewNop()
+}
+
+// newHealthServer 启动只提供健康检查的 grpc 服务, 返回监听地址
+func newHealthServer(t *testing.T, opts ...grpc.ServerOption) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(opts...)
+	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func TestRPCClient(t *testing.T) {
+	ctx := context.Background()
+	addr := newHealthServer(t)
+	re := memory.NewRegistry()
+	_ = re.Register(ctx, &register.ServiceInstance{ID: "1", Name: "im.logic", Endpoints: []string{"grpc://" + addr}})
+
+	cli := NewRPCClient(WithDiscovery(re), WithInsecure(true), WithEendpoint("im.logic"))
+	c1, err := cli.GetConn(ctx, "im.logic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 服务名为空时使用 WithEendpoint
+	c2, err := cli.GetConn(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1 != c2 {
+		t.Fatal("expected cached connection to be shared")
+	}
+	callCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	if _, err = grpc_health_v1.NewHealthClient(c1).Check(callCtx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 带额外 DialOption 的调用使用独占连接
+	c3, err := cli.GetConn(ctx, "im.logic", grpc.WithUserAgent("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c3 == c1 {
+		t.Fatal("expected dedicated connection for per-call options")
+	}
+	if err = cli.Release(c3); err != nil {
+		t.Fatal(err)
+	}
+	if c3.GetState() != connectivity.Shutdown {
+		t.Fatal("expected dedicated connection to be closed on release")
+	}
+
+	// 引用计数归零前不关闭共享连接
+	_ = cli.Release(c1)
+	if c1.GetState() == connectivity.Shutdown {
+		t.Fatal("shared connection closed while still referenced")
+	}
+
+	if err = cli.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c1.GetState() != connectivity.Shutdown {
+		t.Fatal("expected connections to be closed")
+	}
+	if _, err = cli.GetConn(ctx, "im.logic"); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("expected ErrClientClosed, got %v", err)
+	}
+	if _, err = re.Watch(ctx, "im.logic"); err == nil {
+		t.Fatal("expected discovery to be closed")
+	}
+}
+
+func TestRPCClient_Middleware(t *testing.T) {
+	ctx := context.Background()
+	// 服务端回显请求头 x-md-trace, 并设置响应头 x-md-server
+	echo := func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := grpcmd.FromIncomingContext(ctx)
+		_ = grpc.SetHeader(ctx, grpcmd.Pairs("x-md-server", "logic", "x-md-echo", strings.Join(md.Get("x-md-trace"), ",")))
+		return handler(ctx, req)
+	}
+	addr := newHealthServer(t, grpc.UnaryInterceptor(echo))
+	re := memory.NewRegistry()
+	_ = re.Register(ctx, &register.ServiceInstance{ID: "1", Name: "im.logic", Endpoints: []string{"grpc://" + addr}})
+
+	var (
+		calls []string
+		resp  transport.Header
+	)
+	logging := func(name string) mid.Middleware {
+		return func(next mid.Handler) mid.Handler {
+			return func(ctx context.Context, req interface{}) (interface{}, error) {
+				tr, ok := transport.FromClientContext(ctx)
+				if !ok {
+					t.Error("expected client transport in context")
+					return next(ctx, req)
+				}
+				calls = append(calls, name+":"+tr.Operation())
+				tr.RequestHeader().Set("x-md-trace", "trace-1")
+				reply, err := next(ctx, req)
+				resp = tr.ResponseHeader()
+				return reply, err
+			}
+		}
+	}
+	cli := NewRPCClient(
+		WithDiscovery(re),
+		WithInsecure(true),
+		WithMiddleware(logging("global")),
+		WithSelectorMiddleware("/grpc.health.v1.Health/*", logging("health")),
+	)
+	defer func() {
+		_ = cli.Close()
+	}()
+	conn, err := cli.GetConn(ctx, "im.logic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	callCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	if _, err = grpc_health_v1.NewHealthClient(conn).Check(callCtx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	const op = "/grpc.health.v1.Health/Check"
+	if len(calls) != 2 || calls[0] != "global:"+op || calls[1] != "health:"+op {
+		t.Fatalf("unexpected middleware calls %v", calls)
+	}
+	if resp.Get("x-md-server") != "logic" || resp.Get("x-md-echo") != "trace-1" {
+		t.Fatalf("unexpected response header %v", resp)
+	}
+
+	// 流式调用同样经过中间件
+	calls = nil
+	stream, err := grpc_health_v1.NewHealthClient(conn).Watch(callCtx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 2 || calls[0] != "global:/grpc.health.v1.Health/Watch" {
+		t.Fatalf("unexpected middleware calls %v", calls)
+	}
+}
+
+func TestRPCClient_Transport(t *testing.T) {
+	ctx := context.Background()
+	trailer := func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := grpcmd.FromIncomingContext(ctx)
+		_ = grpc.SetTrailer(ctx, grpcmd.Pairs("x-md-user", strings.Join(md.Get("x-md-user"), ",")))
+		return handler(ctx, req)
+	}
+	addr := newHealthServer(t, grpc.UnaryInterceptor(trailer))
+	re := memory.NewRegistry()
+	_ = re.Register(ctx, &register.ServiceInstance{ID: "1", Name: "im.logic", Endpoints: []string{"grpc://" + addr}})
+
+	var tr transport.Transport
+	capture := func(next mid.Handler) mid.Handler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			tr, _ = transport.FromClientContext(ctx)
+			// outgoing metadata 出现在请求头中
+			if tr.RequestHeader().Get("x-md-user") != "u1" {
+				t.Errorf("expected outgoing metadata in request header, got %v", tr.RequestHeader().Keys())
+			}
+			return next(ctx, req)
+		}
+	}
+	cli := NewRPCClient(WithDiscovery(re), WithInsecure(true), WithMiddleware(capture))
+	defer func() {
+		_ = cli.Close()
+	}()
+	conn, err := cli.GetConn(ctx, "im.logic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	callCtx, cancel := context.WithTimeout(grpcmd.AppendToOutgoingContext(ctx, "x-md-user", "u1"), 3*time.Second)
+	defer cancel()
+	client := grpc_health_v1.NewHealthClient(conn)
+	if _, err = client.Check(callCtx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Endpoint() != "grpc://"+addr {
+		t.Fatalf("expected endpoint of chosen instance, got %s", tr.Endpoint())
+	}
+	if tr.Operation() != "/grpc.health.v1.Health/Check" || tr.Scheme() != transport.SchemeGRPC {
+		t.Fatalf("unexpected transport %s %s", tr.Scheme(), tr.Operation())
+	}
+	if tr.ResponseHeader().Get("x-md-user") != "u1" {
+		t.Fatalf("expected trailer in response header, got %v", tr.ResponseHeader().Keys())
+	}
+
+	// 流式调用收到响应后可以读取实际访问的实例
+	stream, err := client.Watch(callCtx, &grpc_health_v1.HealthCheckRequest{Service: "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Endpoint() != "grpc://"+addr {
+		t.Fatalf("expected stream endpoint of chosen instance, got %s", tr.Endpoint())
+	}
+}
+
+func TestRPCClient_StreamRetry(t *testing.T) {
+	ctx := context.Background()
+	// 带有 x-md-retry 的流式调用第一次返回 Unavailable, 重试后正常处理
+	var attempts atomic.Int32
+	flaky := func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if md, _ := grpcmd.FromIncomingContext(ss.Context()); len(md.Get("x-md-retry")) > 0 && attempts.Add(1) == 1 {
+			return status.Error(codes.Unavailable, "try again")
+		}
+		return handler(srv, ss)
+	}
+	addr := newHealthServer(t, grpc.StreamInterceptor(flaky))
+	re := memory.NewRegistry()
+	// 通过实例元数据下发 retryPolicy
+	_ = re.Register(ctx, &register.ServiceInstance{
+		ID:        "1",
+		Name:      "im.logic",
+		Endpoints: []string{"grpc://" + addr},
+		Metadata: map[string]string{register.ServiceConfigKey: `{"methodConfig":[{"name":[{"service":"grpc.health.v1.Health"}],` +
+			`"retryPolicy":{"maxAttempts":2,"initialBackoff":"0.01s","maxBackoff":"0.01s","backoffMultiplier":1,` +
+			`"retryableStatusCodes":["UNAVAILABLE"]}}]}`},
+	})
+
+	var tr transport.Transport
+	capture := func(next mid.Handler) mid.Handler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			tr, _ = transport.FromClientContext(ctx)
+			return next(ctx, req)
+		}
+	}
+	cli := NewRPCClient(WithDiscovery(re), WithInsecure(true), WithMiddleware(capture))
+	defer func() {
+		_ = cli.Close()
+	}()
+	conn, err := cli.GetConn(ctx, "im.logic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	callCtx, cancel := context.WithTimeout(grpcmd.AppendToOutgoingContext(ctx, "x-md-retry", "1"), 3*time.Second)
+	defer cancel()
+	stream, err := grpc_health_v1.NewHealthClient(conn).Watch(callCtx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 中间件创建流时未提交, Unavailable 按 retryPolicy 重试
+	if _, err = stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if attempts.Load() != 2 {
+		t.Fatalf("attempts = %d, want 2", attempts.Load())
+	}
+	if tr.Endpoint() != "grpc://"+addr {
+		t.Fatalf("expected stream endpoint of chosen instance, got %s", tr.Endpoint())
+	}
+}
+
+func TestRPCClient_AppendOutgoing(t *testing.T) {
+	ctx := context.Background()
+	// 服务端回显收到的 metadata, 带有 x-md-user 的流式调用设置 trailer 后返回错误,
+	// 客户端自身的健康检查流不受影响
+	echo := func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := grpcmd.FromIncomingContext(ctx)
+		_ = grpc.SetHeader(ctx, grpcmd.Pairs(
+			"x-md-user", strings.Join(md.Get("x-md-user"), ","),
+			"x-md-extra", strings.Join(md.Get("x-md-extra"), ","),
+		))
+		return handler(ctx, req)
+	}
+	fail := func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if md, _ := grpcmd.FromIncomingContext(ss.Context()); len(md.Get("x-md-user")) == 0 {
+			return handler(srv, ss)
+		}
+		ss.SetTrailer(grpcmd.Pairs("x-md-reason", "denied"))
+		return errors.New("denied")
+	}
+	addr := newHealthServer(t, grpc.UnaryInterceptor(echo), grpc.StreamInterceptor(fail))
+	re := memory.NewRegistry()
+	_ = re.Register(ctx, &register.ServiceInstance{ID: "1", Name: "im.logic", Endpoints: []string{"grpc://" + addr}})
+
+	var tr transport.Transport
+	appendMD := func(next mid.Handler) mid.Handler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			tr, _ = transport.FromClientContext(ctx)
+			return next(grpcmd.AppendToOutgoingContext(ctx, "x-md-extra", "e1", "x-md-user", "u2"), req)
+		}
+	}
+	cli := NewRPCClient(WithDiscovery(re), WithInsecure(true), WithMiddleware(appendMD))
+	defer func() {
+		_ = cli.Close()
+	}()
+	conn, err := cli.GetConn(ctx, "im.logic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	callCtx, cancel := context.WithTimeout(grpcmd.AppendToOutgoingContext(ctx, "x-md-user", "u1"), 3*time.Second)
+	defer cancel()
+	client := grpc_health_v1.NewHealthClient(conn)
+	if _, err = client.Check(callCtx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	// 中间件追加的值随请求发送, 调用方原有的值不重复
+	if got := tr.ResponseHeader().Get("x-md-extra"); got != "e1" {
+		t.Fatalf("x-md-extra = %q, want e1", got)
+	}
+	if got := tr.ResponseHeader().Get("x-md-user"); got != "u1,u2" {
+		t.Fatalf("x-md-user = %q, want u1,u2", got)
+	}
+
+	// 流结束后多次 RecvMsg 只写回一次 trailer
+	stream, err := client.Watch(callCtx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = stream.Recv(); err == nil {
+			t.Fatal("expected stream error")
+		}
+	}
+	if got := tr.ResponseHeader().Values("x-md-reason"); len(got) != 1 {
+		t.Fatalf("x-md-reason = %v, want single value", got)
+	}
+}
+
+func TestRPCClient_RingHashNoSubset(t *testing.T) {
+	ctx := context.Background()
+	re := memory.NewRegistry()
+	// 实例数超过默认子集大小
+	for i := 0; i < 30; i++ {
+		addr := newHealthServer(t)
+		_ = re.Register(ctx, &register.ServiceInstance{ID: addr, Name: "im.logic", Endpoints: []string{"grpc://" + addr}})
+	}
+	newClient := func(id string) func(key string) string {
+		var tr transport.Transport
+		capture := func(next mid.Handler) mid.Handler {
+			return func(ctx context.Context, req interface{}) (interface{}, error) {
+				tr, _ = transport.FromClientContext(ctx)
+				return next(ctx, req)
+			}
+		}
+		cli := NewRPCClient(WithDiscovery(re), WithInsecure(true), WithClientID(id),
+			WithBalancerName(ringhash.Name), WithMiddleware(capture))
+		t.Cleanup(func() {
+			_ = cli.Close()
+		})
+		conn, err := cli.GetConn(ctx, "im.logic")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return func(key string) string {
+			callCtx, cancel := context.WithTimeout(ringhash.WithHashKey(ctx, key), 3*time.Second)
+			defer cancel()
+			if _, err := grpc_health_v1.NewHealthClient(conn).Check(callCtx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+				t.Fatal(err)
+			}
+			return tr.Endpoint()
+		}
+	}
+	c1, c2 := newClient("client-1"), newClient("client-2")
+	// 不同客户端对相同哈希键选择相同实例, 连接建立期间可能暂时落到相邻实例
+	for i := 0; i < 20; i++ {
+		key := "user-" + strconv.Itoa(i)
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			e1, e2 := c1(key), c2(key)
+			if e1 == e2 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("key %s: %s != %s", key, e1, e2)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
@@ -74,10 +74,11 @@ func NewGrpcServer(opts ...ServiceOption) *Service {
 	if len(srv.grpcOpts) > 0 {
 		grpcOpts = append(grpcOpts, srv.grpcOpts...)
 	}
-	if !srv.isOpenHealth {
+	srv.Server = grpc.NewServer(grpcOpts...)
+	// 健康检查需在 grpc.Server 创建后注册
+	if srv.isOpenHealth {
 		grpc_health_v1.RegisterHealthServer(srv.Server, srv.health)
 	}
-	srv.Server = grpc.NewServer(grpcOpts...)
 	reflection.Register(srv.Server)
 
 	srv.adminClean, _ = admin.Register(srv.Server)
@@ -90,7 +91,7 @@ func (s *Service) Use(selector string, m ...mid.Middleware) {
 
 func (s *Service) Endpoint() (*url.URL, error) {
 	if err := s.listenEndpoint(); err != nil {
-		return nil, s.err
+		return nil, err
 	}
 	return s.endpoint, nil
 }
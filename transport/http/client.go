@@ -0,0 +1,219 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yanglunara/discovery/register"
+	"github.com/yanglunara/discovery/transport"
+	mid "github.com/yanglunara/discovery/transport/middleware"
+)
+
+// ErrNoEndpoint 服务没有可用的 http 端点
+var ErrNoEndpoint = errors.New("http client: no available endpoint")
+
+type ClientOption func(c *Client)
+
+// WithEndpoint 设置访问目标, discovery:///<服务名> 通过服务发现解析, 否则视为固定地址, 如 http://127.0.0.1:8000
+func WithEndpoint(endpoint string) ClientOption {
+	return func(c *Client) {
+		c.endpoint = endpoint
+	}
+}
+
+// WithDiscovery 设置解析 discovery:/// 目标使用的服务发现
+func WithDiscovery(d register.Discovery) ClientOption {
+	return func(c *Client) {
+		c.discovery = d
+	}
+}
+
+// WithTimeout 设置请求超时时间
+func WithTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithTransport 设置底层 http.RoundTripper
+func WithTransport(rt http.RoundTripper) ClientOption {
+	return func(c *Client) {
+		c.transport = rt
+	}
+}
+
+// WithMiddleware 设置所有请求使用的客户端中间件
+func WithMiddleware(m ...mid.Middleware) ClientOption {
+	return func(c *Client) {
+		c.middleware.Use(m...)
+	}
+}
+
+// WithSelectorMiddleware 为匹配 selector 的路径设置客户端中间件, selector 以 * 结尾时按前缀匹配
+func WithSelectorMiddleware(selector string, m ...mid.Middleware) ClientOption {
+	return func(c *Client) {
+		c.middleware.Add(selector, m...)
+	}
+}
+
+// Client 访问单个服务的 http 客户端, 在服务的 http/https 端点间轮询
+type Client struct {
+	endpoint   string
+	discovery  register.Discovery
+	timeout    time.Duration
+	transport  http.RoundTripper
+	middleware transport.Matcher
+	cli        *http.Client
+
+	lock      sync.RWMutex
+	endpoints []*url.URL
+	next      atomic.Uint64
+	w         register.Watcher
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// NewClient 创建客户端, 通过服务发现解析时等待首次实例列表, 直到 ctx 结束
+func NewClient(ctx context.Context, opts ...ClientOption) (*Client, error) {
+	c := &Client{
+		timeout:    2 * time.Second,
+		transport:  http.DefaultTransport,
+		middleware: transport.NewMatcher(),
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	c.cli = &http.Client{Transport: c.transport, Timeout: c.timeout}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	target, err := url.Parse(c.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme != "discovery" {
+		if target.Host == "" {
+			return nil, fmt.Errorf("http client: invalid endpoint %q", c.endpoint)
+		}
+		c.endpoints = []*url.URL{target}
+		return c, nil
+	}
+	if c.discovery == nil {
+		return nil, errors.New("http client: discovery is required for discovery:/// endpoint")
+	}
+	if c.w, err = c.discovery.Watch(c.ctx, strings.TrimPrefix(target.Path, "/")); err != nil {
+		return nil, err
+	}
+	ready := make(chan struct{})
+	go c.watch(ready)
+	select {
+	case <-ready:
+		return c, nil
+	case <-ctx.Done():
+		_ = c.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// watch 持续更新 http 端点, 首次收到实例列表后关闭 ready
+func (c *Client) watch(ready chan struct{}) {
+	var once sync.Once
+	for {
+		ins, err := c.w.Next()
+		if c.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		endpoints := parseEndpoints(ins)
+		c.lock.Lock()
+		c.endpoints = endpoints
+		c.lock.Unlock()
+		once.Do(func() {
+			close(ready)
+		})
+	}
+}
+
+// parseEndpoints 取每个实例的第一个 http 或 https 端点
+func parseEndpoints(ins []*register.ServiceInstance) []*url.URL {
+	endpoints := make([]*url.URL, 0, len(ins))
+	for _, in := range ins {
+		for _, e := range in.Endpoints {
+			u, err := url.Parse(e)
+			if err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+				endpoints = append(endpoints, u)
+				break
+			}
+		}
+	}
+	return endpoints
+}
+
+func (c *Client) pick() (*url.URL, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if len(c.endpoints) == 0 {
+		return nil, ErrNoEndpoint
+	}
+	return c.endpoints[(c.next.Add(1)-1)%uint64(len(c.endpoints))], nil
+}
+
+// Do 将请求发送到选中的实例, 请求 URL 只需包含路径与查询参数
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	endpoint, err := c.pick()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.URL.Scheme = endpoint.Scheme
+	req.URL.Host = endpoint.Host
+	req.Host = endpoint.Host
+	tr := &Transport{
+		endpoint:   endpoint.String(),
+		operation:  req.URL.Path,
+		request:    req,
+		reqHeader:  headerCarrier(req.Header),
+		respHeader: headerCarrier{},
+	}
+	ctx := transport.NewClientContext(req.Context(), tr)
+	h := func(ctx context.Context, in interface{}) (interface{}, error) {
+		resp, err := c.cli.Do(in.(*http.Request).WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range resp.Header {
+			tr.respHeader[k] = v
+		}
+		return resp, nil
+	}
+	if next := c.middleware.Match(tr.Operation()); len(next) > 0 {
+		h = mid.Next(next...)(h)
+	}
+	resp, err := h(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*http.Response), nil
+}
+
+// Close 停止监听服务实例, 服务发现由调用方负责关闭
+func (c *Client) Close() error {
+	c.cancel()
+	if c.w != nil {
+		return c.w.Close()
+	}
+	return nil
+}
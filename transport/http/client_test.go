@@ -0,0 +1,89 @@
+package http
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yanglunara/discovery/register"
+	"github.com/yanglunara/discovery/transport"
+	mid "github.com/yanglunara/discovery/transport/middleware"
+	"github.com/yanglunara/discovery/watcher/memory"
+)
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	re := memory.NewRegistry()
+	for _, id := range []string{"1", "2"} {
+		id := id
+		srv := NewServer(Address("127.0.0.1:0"))
+		srv.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Instance", id)
+			_, _ = io.WriteString(w, r.Header.Get("X-User"))
+		})
+		endpoint := startServer(t, srv)
+		_ = re.Register(ctx, &register.ServiceInstance{
+			ID:        id,
+			Name:      "im.api",
+			Endpoints: []string{"grpc://127.0.0.1:1", endpoint},
+		})
+	}
+
+	var endpoints []string
+	user := func(next mid.Handler) mid.Handler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			tr, _ := transport.FromClientContext(ctx)
+			tr.RequestHeader().Set("X-User", "u1")
+			reply, err := next(ctx, req)
+			endpoints = append(endpoints, tr.Endpoint()+"#"+tr.ResponseHeader().Get("X-Instance"))
+			return reply, err
+		}
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	cli, err := NewClient(waitCtx, WithEndpoint("discovery:///im.api"), WithDiscovery(re), WithMiddleware(user))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = cli.Close()
+	}()
+
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "/whoami", nil)
+		resp, err := cli.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != "u1" {
+			t.Fatalf("expected header from middleware, got %q", body)
+		}
+		seen[resp.Header.Get("X-Instance")] = true
+	}
+	if !seen["1"] || !seen["2"] {
+		t.Fatalf("expected requests spread over instances, got %v", seen)
+	}
+	if len(endpoints) != 4 || endpoints[0][:len("http://")] != "http://" {
+		t.Fatalf("unexpected transport endpoints %v", endpoints)
+	}
+
+	// 固定地址不需要服务发现
+	static, err := NewClient(ctx, WithEndpoint(endpoints[0][:len(endpoints[0])-2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "/whoami", nil)
+	resp, err := static.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if _, err = NewClient(ctx, WithEndpoint("discovery:///im.api")); err == nil {
+		t.Fatal("expected error without discovery")
+	}
+}
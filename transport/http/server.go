@@ -0,0 +1,180 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/yanglunara/discovery/lib"
+	"github.com/yanglunara/discovery/transport"
+	mid "github.com/yanglunara/discovery/transport/middleware"
+)
+
+var (
+	_ transport.GrpcService = (*Server)(nil)
+	_ transport.EndPointer  = (*Server)(nil)
+	_ http.Handler          = (*Server)(nil)
+)
+
+// readHeaderTimeout 读取请求头的超时时间
+const readHeaderTimeout = 10 * time.Second
+
+type ServerOption func(s *Server)
+
+func Network(network string) ServerOption {
+	return func(s *Server) {
+		s.network = network
+	}
+}
+
+func Address(address string) ServerOption {
+	return func(s *Server) {
+		s.address = address
+	}
+}
+
+// Timeout 设置请求处理超时时间
+func Timeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.timeout = timeout
+	}
+}
+
+// Middleware 设置所有路由使用的中间件
+func Middleware(m ...mid.Middleware) ServerOption {
+	return func(s *Server) {
+		s.middleware.Use(m...)
+	}
+}
+
+// Listener 使用已创建的监听器
+func Listener(lis net.Listener) ServerOption {
+	return func(s *Server) {
+		s.lis = lis
+	}
+}
+
+type Server struct {
+	*http.Server
+	lis        net.Listener
+	router     *http.ServeMux
+	middleware transport.Matcher
+	endpoint   *url.URL
+	timeout    time.Duration
+	network    string
+	address    string
+	err        error
+}
+
+func NewServer(opts ...ServerOption) *Server {
+	srv := &Server{
+		network:    "tcp",
+		address:    ":8000",
+		timeout:    1 * time.Second,
+		router:     http.NewServeMux(),
+		middleware: transport.NewMatcher(),
+	}
+	for _, opt := range opts {
+		opt(srv)
+	}
+	srv.Server = &http.Server{
+		Handler: srv,
+		// 限制读取请求头的时间, 避免慢速客户端长期占用连接
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+	return srv
+}
+
+// Use 为匹配 selector 的路径设置中间件, selector 以 * 结尾时按前缀匹配
+func (s *Server) Use(selector string, m ...mid.Middleware) {
+	s.middleware.Add(selector, m...)
+}
+
+// Handle 注册路由, 与 http.ServeMux 的规则一致
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.router.Handle(pattern, h)
+}
+
+func (s *Server) HandleFunc(pattern string, h http.HandlerFunc) {
+	s.router.HandleFunc(pattern, h)
+}
+
+// ServeHTTP 创建服务端 Transport, 以请求路径为 operation 执行匹配的中间件后交给路由处理
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	tr := &Transport{
+		operation:  r.URL.Path,
+		request:    r,
+		reqHeader:  headerCarrier(r.Header),
+		respHeader: headerCarrier(w.Header()),
+	}
+	if s.endpoint != nil {
+		tr.endpoint = s.endpoint.String()
+	}
+	ctx = transport.NewServiceContext(ctx, tr)
+	served := false
+	h := func(ctx context.Context, req interface{}) (interface{}, error) {
+		served = true
+		s.router.ServeHTTP(w, req.(*http.Request).WithContext(ctx))
+		return nil, nil
+	}
+	if next := s.middleware.Match(tr.Operation()); len(next) > 0 {
+		h = mid.Next(next...)(h)
+	}
+	// 中间件拦截请求时返回错误, 路由未执行; 路由已写入响应时不再覆盖
+	if _, err := h(ctx, r); err != nil && !served {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) Endpoint() (*url.URL, error) {
+	if err := s.listenEndpoint(); err != nil {
+		return nil, err
+	}
+	return s.endpoint, nil
+}
+
+func (s *Server) listenEndpoint() error {
+	if s.lis == nil {
+		lis, err := net.Listen(s.network, s.address)
+		if err != nil {
+			s.err = err
+			return err
+		}
+		s.lis = lis
+	}
+	if s.endpoint == nil {
+		addr, err := lib.Extract(s.address, s.lis)
+		if err != nil {
+			s.err = err
+			return err
+		}
+		s.endpoint = lib.NewEndpoint("http", addr)
+	}
+	return s.err
+}
+
+func (s *Server) Start(ctx context.Context) error {
+	if err := s.listenEndpoint(); err != nil {
+		return err
+	}
+	s.BaseContext = func(net.Listener) context.Context {
+		return ctx
+	}
+	if err := s.Serve(s.lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) Stop(ctx context.Context) error {
+	return s.Shutdown(ctx)
+}
@@ -0,0 +1,124 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yanglunara/discovery/transport"
+	mid "github.com/yanglunara/discovery/transport/middleware"
+)
+
+// startServer 启动服务并在测试结束时停止
+func startServer(t *testing.T, srv *Server) string {
+	t.Helper()
+	endpoint, err := srv.Endpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Start(context.Background())
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = srv.Stop(ctx)
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	return endpoint.String()
+}
+
+func TestServer(t *testing.T) {
+	var operations []string
+	trace := func(next mid.Handler) mid.Handler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			tr, ok := transport.FromServiceContext(ctx)
+			if !ok {
+				return nil, errors.New("missing transport")
+			}
+			operations = append(operations, tr.Operation())
+			tr.ResponseHeader().Set("X-Trace", tr.RequestHeader().Get("X-Request-Id"))
+			return next(ctx, req)
+		}
+	}
+	deny := func(mid.Handler) mid.Handler {
+		return func(context.Context, interface{}) (interface{}, error) {
+			return nil, errors.New("forbidden")
+		}
+	}
+	srv := NewServer(Address("127.0.0.1:0"), Middleware(trace))
+	srv.Use("/admin/*", deny)
+	srv.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	})
+	srv.HandleFunc("/admin/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "admin")
+	})
+	endpoint := startServer(t, srv)
+	if endpoint[:len("http://")] != "http://" {
+		t.Fatalf("unexpected endpoint %s", endpoint)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, endpoint+"/hello", nil)
+	req.Header.Set("X-Request-Id", "r1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "hello" || resp.Header.Get("X-Trace") != "r1" {
+		t.Fatalf("unexpected response %q %v", body, resp.Header)
+	}
+
+	// 按路由匹配的中间件拦截请求
+	resp, err = http.Get(endpoint + "/admin/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected request to be rejected, got %d", resp.StatusCode)
+	}
+	if len(operations) != 2 || operations[0] != "/hello" || operations[1] != "/admin/users" {
+		t.Fatalf("unexpected operations %v", operations)
+	}
+
+	// 默认限制读取请求头的时间
+	if got := srv.ReadHeaderTimeout; got <= 0 {
+		t.Fatalf("ReadHeaderTimeout = %v", got)
+	}
+}
+
+func TestServer_AfterHandlerError(t *testing.T) {
+	audit := func(next mid.Handler) mid.Handler {
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			if _, err := next(ctx, req); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("audit failed")
+		}
+	}
+	srv := NewServer(Address("127.0.0.1:0"), Middleware(audit))
+	srv.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	})
+	endpoint := startServer(t, srv)
+
+	// 路由执行后中间件返回的错误不再写入响应
+	resp, err := http.Get(endpoint + "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,70 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/yanglunara/discovery/transport"
+)
+
+var (
+	_ transport.Transport = (*Transport)(nil)
+)
+
+type Transport struct {
+	endpoint   string
+	operation  string
+	request    *http.Request
+	reqHeader  headerCarrier
+	respHeader headerCarrier
+}
+
+func (tr *Transport) Scheme() transport.Scheme {
+	return transport.ShenmeHTTP
+}
+
+func (tr *Transport) Endpoint() string {
+	return tr.endpoint
+}
+
+func (tr *Transport) Operation() string {
+	return tr.operation
+}
+
+// Request 原始请求
+func (tr *Transport) Request() *http.Request {
+	return tr.request
+}
+
+func (tr *Transport) RequestHeader() transport.Header {
+	return tr.reqHeader
+}
+
+func (tr *Transport) ResponseHeader() transport.Header {
+	return tr.respHeader
+}
+
+type headerCarrier http.Header
+
+func (hc headerCarrier) Get(key string) string {
+	return http.Header(hc).Get(key)
+}
+
+func (hc headerCarrier) Set(key, value string) {
+	http.Header(hc).Set(key, value)
+}
+
+func (hc headerCarrier) Add(key, value string) {
+	http.Header(hc).Add(key, value)
+}
+
+func (hc headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(hc))
+	for k := range hc {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (hc headerCarrier) Values(key string) []string {
+	return http.Header(hc).Values(key)
+}
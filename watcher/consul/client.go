@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/consul/api"
@@ -15,6 +16,7 @@ import (
 
 type Client struct {
 	dc           string
+	scope        *scope // 查询作用域, 为空时使用 consul 客户端的默认值
 	ctx          context.Context
 	cancel       context.CancelFunc
 	cli          *api.Client
@@ -28,7 +30,9 @@ type Client struct {
 	timeout                        time.Duration
 	healthCheckInterval            time.Duration
 
-	entries register.Entries
+	entries Entries
+
+	serviceConfigPrefix string // service config 在 KV 中的前缀, 为空时不读取
 }
 
 func (c *Client) Service(ctx context.Context, service string, index uint64, passingOnly bool) ([]*register.ServiceInstance, uint64, error) {
@@ -37,21 +41,76 @@ func (c *Client) Service(ctx context.Context, service string, index uint64, pass
 		WaitTime:  time.Second * 55,
 	}
 	opts = opts.WithContext(ctx)
-	if c.dc == "MULTI" {
-		return c.entries.MultiDCService(ctx, &register.EntriesOption{
+	if c.scope != nil {
+		c.scope.apply(opts)
+	}
+	var (
+		ins []*register.ServiceInstance
+		idx uint64
+		err error
+	)
+	// 指定了数据中心时只查询该数据中心
+	if c.dc == MultiDataCenter && opts.Datacenter == "" {
+		ins, idx, err = c.entries.MultiDCService(ctx, &EntriesOption{
 			Service:     service,
 			Index:       index,
 			PassingOnly: passingOnly,
 			Opts:        opts,
 		})
+	} else {
+		ins, idx, err = c.entries.SingleDCEntries(ctx, &EntriesOption{
+			Service:     service,
+			PassingOnly: passingOnly,
+			Opts:        opts,
+			Index:       index,
+		})
 	}
-	return c.entries.SingleDCEntries(ctx, &register.EntriesOption{
-		Service:     service,
-		PassingOnly: passingOnly,
-		Opts:        opts,
-		Index:       index,
-	})
+	if err != nil {
+		return nil, 0, err
+	}
+	c.injectServiceConfig(ctx, service, ins)
+	return ins, idx, nil
+}
 
+// injectServiceConfig 将 KV 中的 service config 写入实例元数据, 读取失败时保留实例自身的配置
+func (c *Client) injectServiceConfig(ctx context.Context, service string, ins []*register.ServiceInstance) {
+	if c.serviceConfigPrefix == "" || len(ins) == 0 {
+		return
+	}
+	opts := new(api.QueryOptions)
+	if c.scope != nil {
+		c.scope.apply(opts)
+	}
+	pair, _, err := c.cli.KV().Get(c.serviceConfigKey(service), opts.WithContext(ctx))
+	if err != nil || pair == nil || len(pair.Value) == 0 {
+		return
+	}
+	for _, in := range ins {
+		if in.Metadata == nil {
+			in.Metadata = make(map[string]string, 1)
+		}
+		in.Metadata[register.ServiceConfigKey] = string(pair.Value)
+	}
+}
+
+func (c *Client) serviceConfigKey(service string) string {
+	return strings.TrimSuffix(c.serviceConfigPrefix, "/") + "/" + service
+}
+
+// serviceConfigIndex 阻塞查询服务的 service config, KV 变更或超时后返回最新索引
+func (c *Client) serviceConfigIndex(ctx context.Context, service string, index uint64) (uint64, error) {
+	opts := &api.QueryOptions{
+		WaitIndex: index,
+		WaitTime:  time.Second * 55,
+	}
+	if c.scope != nil {
+		c.scope.apply(opts)
+	}
+	_, meta, err := c.cli.KV().Get(c.serviceConfigKey(service), opts.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	return meta.LastIndex, nil
 }
 
 // Deregister 注销服务
@@ -87,6 +146,10 @@ func (c *Client) Register(ctx context.Context, service *register.ServiceInstance
 		Tags:            []string{fmt.Sprintf("version=%s", service.Version)},
 		TaggedAddresses: address,
 	}
+	// 元数据中的 tags 以 consul 标签注册, 与解析时保持一致
+	if tags := service.Metadata["tags"]; tags != "" {
+		asr.Tags = append(asr.Tags, strings.Split(tags, ",")...)
+	}
 	if len(checkAddress) > 0 {
 		host, portRaw, _ := net.SplitHostPort(checkAddress[0])
 		port, _ := strconv.ParseUint(portRaw, 10, 32)
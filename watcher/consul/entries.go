@@ -8,22 +8,46 @@ import (
 )
 
 var (
-	_ register.Entries = (*entries)(nil)
+	_ Entries = (*entries)(nil)
 )
 
+// 数据中心类型
+const (
+	SingleDataCenter = "SINGLE" // 单数据中心
+	MultiDataCenter  = "MULTI"  // 多数据中心
+)
+
+// Resolver 将 consul 健康检查条目解析为服务实例
+type Resolver = register.Resolver[*api.ServiceEntry]
+
+// EntriesOption 条目选项
+type EntriesOption struct {
+	Resolver
+	Service, Tag string
+	Index        uint64
+	PassingOnly  bool
+	Opts         *api.QueryOptions
+}
+
+// Entries 条目接口
+type Entries interface {
+	MultiDCService(ctx context.Context, en *EntriesOption) ([]*register.ServiceInstance, uint64, error)  // 多数据中心服务
+	SingleDCEntries(ctx context.Context, en *EntriesOption) ([]*register.ServiceInstance, uint64, error) // 单数据中心条目
+}
+
 type entries struct {
-	resolver register.Resolver
+	resolver Resolver
 	cli      *api.Client
 }
 
-func NewEntries(resolver register.Resolver, cli *api.Client) register.Entries {
+func NewEntries(resolver Resolver, cli *api.Client) Entries {
 	return &entries{
 		resolver,
 		cli,
 	}
 }
 
-func (e *entries) MultiDCService(ctx context.Context, en *register.EntriesOption) ([]*register.ServiceInstance, uint64, error) {
+func (e *entries) MultiDCService(ctx context.Context, en *EntriesOption) ([]*register.ServiceInstance, uint64, error) {
 	var (
 		services []*register.ServiceInstance
 	)
@@ -50,7 +74,7 @@ func (e *entries) MultiDCService(ctx context.Context, en *register.EntriesOption
 	}
 	return services, en.Opts.WaitIndex, nil
 }
-func (e *entries) SingleDCEntries(ctx context.Context, en *register.EntriesOption) ([]*register.ServiceInstance, uint64, error) {
+func (e *entries) SingleDCEntries(ctx context.Context, en *EntriesOption) ([]*register.ServiceInstance, uint64, error) {
 	entries, meta, err := e.singleDCEntries(en.Service, "", en.PassingOnly, en.Opts)
 	if err != nil {
 		return nil, 0, err
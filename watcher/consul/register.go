@@ -17,13 +17,25 @@ var (
 	_ register.Discovery = (*Registry)(nil)
 )
 
-func NewRegistry(client *api.Client) *Registry {
+// Option 注册中心选项
+type Option func(r *Registry)
+
+// WithServiceConfigPrefix 从 consul KV 的 <prefix>/<服务名> 读取 grpc service config,
+// 写入实例元数据 register.ServiceConfigKey, 优先于实例自身发布的配置.
+// Watch 同时监听该 KV, 变更后立即推送
+func WithServiceConfigPrefix(prefix string) Option {
+	return func(r *Registry) {
+		r.cli.serviceConfigPrefix = prefix
+	}
+}
+
+func NewRegistry(client *api.Client, opts ...Option) *Registry {
 	r := &Registry{
 		registry: make(map[string]*service),
 		timeout:  10 * time.Second,
 		cli: &Client{
 			cli:                            client,
-			dc:                             "SINGLE",
+			dc:                             SingleDataCenter,
 			healthCheckInterval:            10 * time.Second,
 			heartBeat:                      true,
 			deregisterCriticalServiceAfter: 600 * time.Second,
@@ -36,6 +48,9 @@ func NewRegistry(client *api.Client) *Registry {
 	// 初始化 entries
 	r.cli.entries = NewEntries(NewResolver(r.cli.ctx), r.cli.cli)
 	r.cli.timeout = r.timeout
+	for _, o := range opts {
+		o(r)
+	}
 
 	return r
 }
@@ -137,6 +152,9 @@ func (r *Registry) resolve(ctx context.Context, ss *service) (err error) {
 	if len(entries) > 0 {
 		ss.broadcast(entries)
 	}
+	if r.cli.serviceConfigPrefix != "" {
+		go r.watchServiceConfig(ctx, ss)
+	}
 	go func() {
 		ticker := time.NewTicker(time.Second)
 		defer ticker.Stop()
@@ -165,6 +183,35 @@ func (r *Registry) resolve(ctx context.Context, ss *service) (err error) {
 	return nil
 }
 
+// watchServiceConfig 监听服务在 KV 中的 service config, 变更后重新获取实例并广播
+func (r *Registry) watchServiceConfig(ctx context.Context, ss *service) {
+	var idx uint64
+	for {
+		next, err := r.cli.serviceConfigIndex(ctx, ss.serviceName, idx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		// 首次查询只记录索引, 当前配置已在获取实例时写入
+		if idx != 0 && next != idx {
+			timeOutCtx, cancel := context.WithTimeout(ctx, r.timeout)
+			entries, _, err := r.cli.Service(timeOutCtx, ss.serviceName, 0, true)
+			cancel()
+			if err == nil && len(entries) > 0 {
+				ss.broadcast(entries)
+			}
+		}
+		idx = next
+	}
+}
+
 func (r *Registry) Close() error {
 	r.registry = nil
 	r.cli.Close()
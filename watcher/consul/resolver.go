@@ -10,14 +10,14 @@ import (
 )
 
 var (
-	_ register.Resolver = (*resolver)(nil)
+	_ Resolver = (*resolver)(nil)
 )
 
 type resolver struct {
 	ctx context.Context
 }
 
-func NewResolver(ctx context.Context) register.Resolver {
+func NewResolver(ctx context.Context) Resolver {
 	return &resolver{
 		ctx: ctx,
 	}
@@ -26,11 +26,25 @@ func NewResolver(ctx context.Context) register.Resolver {
 func (r *resolver) ServiceResolver(ctx context.Context, entries []*consulApi.ServiceEntry) []*register.ServiceInstance {
 	services := make([]*register.ServiceInstance, 0, len(entries))
 	for _, entry := range entries {
-		var version string
+		var (
+			version string
+			tags    []string
+		)
 		for _, tag := range entry.Service.Tags {
 			if ss := strings.SplitN(tag, "=", 2); len(ss) == 2 && ss[0] == "version" {
 				version = ss[1]
+				continue
 			}
+			tags = append(tags, tag)
+		}
+		// 复制元数据, 避免修改 consul 返回的原始条目
+		metadata := make(map[string]string, len(entry.Service.Meta)+1)
+		for k, v := range entry.Service.Meta {
+			metadata[k] = v
+		}
+		// 除 version 外的标签以逗号拼接写入 tags 元数据
+		if len(tags) > 0 {
+			metadata["tags"] = strings.Join(tags, ",")
 		}
 		endpoints := make([]string, 0)
 		for scheme, addr := range entry.Service.TaggedAddresses {
@@ -47,7 +61,7 @@ func (r *resolver) ServiceResolver(ctx context.Context, entries []*consulApi.Ser
 		services = append(services, &register.ServiceInstance{
 			ID:        entry.Service.ID,
 			Name:      entry.Service.Service,
-			Metadata:  entry.Service.Meta,
+			Metadata:  metadata,
 			Version:   version,
 			Endpoints: endpoints,
 		})
@@ -0,0 +1,112 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/yanglunara/discovery/register"
+)
+
+var (
+	_ register.Scoper = (*Registry)(nil)
+)
+
+// scope 查询作用域
+type scope struct {
+	datacenter string
+	namespace  string
+	partition  string
+}
+
+// parseScope 按 consul DNS 的写法解析 authority:
+//
+//	sh                      数据中心 sh
+//	sh.dc                   数据中心 sh
+//	team.ns.sh.dc           数据中心 sh 下的命名空间 team
+//	team.ns.billing.ap      分区 billing 下的命名空间 team
+func parseScope(authority string) (*scope, error) {
+	parts := strings.Split(authority, ".")
+	if len(parts) == 1 && parts[0] != "" {
+		return &scope{datacenter: parts[0]}, nil
+	}
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("consul: invalid authority %q", authority)
+	}
+	sc := new(scope)
+	for i := 0; i < len(parts); i += 2 {
+		value, kind := parts[i], parts[i+1]
+		if value == "" {
+			return nil, fmt.Errorf("consul: invalid authority %q", authority)
+		}
+		switch kind {
+		case "dc":
+			sc.datacenter = value
+		case "ns":
+			sc.namespace = value
+		case "ap":
+			sc.partition = value
+		default:
+			return nil, fmt.Errorf("consul: unknown scope %q in authority %q", kind, authority)
+		}
+	}
+	return sc, nil
+}
+
+func (sc *scope) apply(opts *api.QueryOptions) {
+	if sc.datacenter != "" {
+		opts.Datacenter = sc.datacenter
+	}
+	if sc.namespace != "" {
+		opts.Namespace = sc.namespace
+	}
+	if sc.partition != "" {
+		opts.Partition = sc.partition
+	}
+}
+
+// Scope 返回查询指定数据中心、命名空间或分区的服务发现, 与原注册中心共用 consul 客户端.
+// 返回值只用于服务发现, 注册实例仍需通过原注册中心
+func (r *Registry) Scope(authority string) (register.Discovery, error) {
+	sc, err := parseScope(authority)
+	if err != nil {
+		return nil, err
+	}
+	s := &Registry{
+		registry: make(map[string]*service),
+		timeout:  r.timeout,
+		cli: &Client{
+			cli:     r.cli.cli,
+			dc:      r.cli.dc,
+			scope:   sc,
+			timeout: r.timeout,
+
+			serviceConfigPrefix: r.cli.serviceConfigPrefix,
+		},
+	}
+	s.cli.ctx, s.cli.cancel = context.WithCancel(context.Background())
+	s.cli.entries = NewEntries(NewResolver(s.cli.ctx), s.cli.cli)
+	return &scoped{registry: s}, nil
+}
+
+var (
+	_ register.Discovery = (*scoped)(nil)
+)
+
+// scoped 作用域内的服务发现, 不暴露 Register, 避免通过类型断言使用未配置健康检查的客户端注册
+type scoped struct {
+	registry *Registry
+}
+
+func (s *scoped) GetService(ctx context.Context, serviceName string) ([]*register.ServiceInstance, error) {
+	return s.registry.GetService(ctx, serviceName)
+}
+
+func (s *scoped) Watch(ctx context.Context, serviceName string) (register.Watcher, error) {
+	return s.registry.Watch(ctx, serviceName)
+}
+
+func (s *scoped) Close() error {
+	return s.registry.Close()
+}
@@ -0,0 +1,63 @@
+package consul
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/yanglunara/discovery/register"
+)
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		authority string
+		want      scope
+		err       bool
+	}{
+		{authority: "sh", want: scope{datacenter: "sh"}},
+		{authority: "sh.dc", want: scope{datacenter: "sh"}},
+		{authority: "team.ns.sh.dc", want: scope{datacenter: "sh", namespace: "team"}},
+		{authority: "team.ns.billing.ap.sh.dc", want: scope{datacenter: "sh", namespace: "team", partition: "billing"}},
+		{authority: "a.b.c", err: true},
+		{authority: "sh.zone", err: true},
+		{authority: ".dc", err: true},
+		{authority: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.authority, func(t *testing.T) {
+			got, err := parseScope(tt.authority)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Fatalf("want %+v, got %+v", tt.want, *got)
+			}
+		})
+	}
+}
+
+func TestRegistry_Scope(t *testing.T) {
+	cli, err := api.NewClient(&api.Config{Address: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewRegistry(cli).Scope("team.ns.sh.dc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 作用域只用于服务发现, 不能通过类型断言注册实例
+	if _, ok := d.(register.Registrar); ok {
+		t.Fatal("scoped discovery must not implement Registrar")
+	}
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewRegistry(cli).Scope("a.b.c"); err == nil {
+		t.Fatal("expected error for invalid authority")
+	}
+}
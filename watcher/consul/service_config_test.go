@@ -0,0 +1,152 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/yanglunara/discovery/register"
+)
+
+func TestServiceConfigPrefix(t *testing.T) {
+	const sc = `{"loadBalancingConfig":[{"round_robin":{}}]}`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/health/service/im.logic", func(w http.ResponseWriter, r *http.Request) {
+		if dc := r.URL.Query().Get("dc"); dc != "sh" {
+			t.Errorf("expected datacenter sh, got %q", dc)
+		}
+		_ = json.NewEncoder(w).Encode([]*api.ServiceEntry{{
+			Service: &api.AgentService{
+				ID:      "1",
+				Service: "im.logic",
+				Tags:    []string{"version=v1", "canary"},
+				Meta:    map[string]string{register.ServiceConfigKey: `{}`},
+				TaggedAddresses: map[string]api.ServiceAddress{
+					"grpc": {Address: "grpc://127.0.0.1:9000", Port: 9000},
+				},
+			},
+		}})
+	})
+	mux.HandleFunc("/v1/kv/grpc/service-config/im.logic", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode([]*api.KVPair{{Key: "grpc/service-config/im.logic", Value: []byte(sc)}})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cli, err := api.NewClient(&api.Config{Address: srv.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewRegistry(cli, WithServiceConfigPrefix("grpc/service-config/")).Scope("sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := d.GetService(context.Background(), "im.logic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 1 {
+		t.Fatalf("unexpected instances %v", ss)
+	}
+	if got := ss[0].Metadata[register.ServiceConfigKey]; got != sc {
+		t.Fatalf("expected service config from KV, got %s", got)
+	}
+	if ss[0].Version != "v1" || ss[0].Metadata["tags"] != "canary" {
+		t.Fatalf("unexpected version or tags %+v", ss[0])
+	}
+}
+
+// fakeKV 支持阻塞查询的单个 KV
+type fakeKV struct {
+	lock    sync.Mutex
+	index   uint64
+	value   string
+	changed chan struct{}
+}
+
+func (kv *fakeKV) set(value string) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	kv.index++
+	kv.value = value
+	close(kv.changed)
+	kv.changed = make(chan struct{})
+}
+
+func (kv *fakeKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kv.lock.Lock()
+	index, value, changed := kv.index, kv.value, kv.changed
+	kv.lock.Unlock()
+	if r.URL.Query().Get("index") == strconv.FormatUint(index, 10) {
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		kv.lock.Lock()
+		index, value = kv.index, kv.value
+		kv.lock.Unlock()
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	_ = json.NewEncoder(w).Encode([]*api.KVPair{{Key: "grpc/service-config/im.logic", Value: []byte(value)}})
+}
+
+func TestServiceConfigPrefix_Watch(t *testing.T) {
+	kv := &fakeKV{index: 1, value: `{"loadBalancingConfig":[{"round_robin":{}}]}`, changed: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/health/service/im.logic", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode([]*api.ServiceEntry{{
+			Service: &api.AgentService{
+				ID:      "1",
+				Service: "im.logic",
+				TaggedAddresses: map[string]api.ServiceAddress{
+					"grpc": {Address: "grpc://127.0.0.1:9000", Port: 9000},
+				},
+			},
+		}})
+	})
+	mux.Handle("/v1/kv/grpc/service-config/im.logic", kv)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cli, err := api.NewClient(&api.Config{Address: srv.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRegistry(cli, WithServiceConfigPrefix("grpc/service-config"))
+	w, err := r.Watch(context.Background(), "im.logic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = w.Close()
+	}()
+	ss, err := w.Next()
+	if err != nil || len(ss) != 1 || ss[0].Metadata[register.ServiceConfigKey] != kv.value {
+		t.Fatalf("unexpected instances %+v, %v", ss, err)
+	}
+
+	// 实例不变时 KV 变更也会推送
+	const updated = `{"loadBalancingConfig":[{"pick_first":{}}]}`
+	time.Sleep(100 * time.Millisecond)
+	kv.set(updated)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ss, err = w.Next()
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("service config change not pushed")
+	}
+	if err != nil || len(ss) != 1 || ss[0].Metadata[register.ServiceConfigKey] != updated {
+		t.Fatalf("unexpected instances %+v, %v", ss, err)
+	}
+}
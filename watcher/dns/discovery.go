@@ -0,0 +1,267 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/yanglunara/discovery/register"
+)
+
+var (
+	_ register.Discovery = (*Discovery)(nil)
+
+	ErrNoNameserver = errors.New("dns: no nameserver configured")
+)
+
+// Option DNS 服务发现选项
+type Option func(o *options)
+
+type options struct {
+	nameserver string        // DNS 服务器地址, host:port
+	service    string        // SRV 记录中的服务名, _<service>._<proto>.<name>
+	proto      string        // SRV 记录中的协议
+	domain     string        // 追加在服务名后的域名
+	scheme     string        // 生成端点使用的 scheme
+	timeout    time.Duration // 单次查询超时
+	minRefresh time.Duration // 最短轮询间隔, 避免 TTL 过小时频繁查询
+	maxRefresh time.Duration // 最长轮询间隔, TTL 为 0 时也使用该值
+}
+
+// Nameserver 设置 DNS 服务器地址, 默认读取 /etc/resolv.conf
+func Nameserver(addr string) Option {
+	return func(o *options) {
+		o.nameserver = addr
+	}
+}
+
+// Service 设置 SRV 记录的服务名与协议, 默认 _grpc._tcp
+func Service(service, proto string) Option {
+	return func(o *options) {
+		o.service = service
+		o.proto = proto
+	}
+}
+
+// Domain 设置追加在服务名后的域名, 例如 svc.cluster.local
+func Domain(domain string) Option {
+	return func(o *options) {
+		o.domain = domain
+	}
+}
+
+// Timeout 设置单次查询超时
+func Timeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// Refresh 设置轮询间隔的上下限, 实际间隔为记录 TTL
+func Refresh(minInterval, maxInterval time.Duration) Option {
+	return func(o *options) {
+		o.minRefresh = minInterval
+		o.maxRefresh = maxInterval
+	}
+}
+
+// Discovery 基于 DNS SRV 记录的服务发现
+type Discovery struct {
+	opts   *options
+	client *dns.Client
+	tcp    *dns.Client // UDP 响应被截断时改用 TCP 重新查询
+}
+
+func NewDiscovery(opts ...Option) (*Discovery, error) {
+	op := &options{
+		service:    "grpc",
+		proto:      "tcp",
+		scheme:     "grpc",
+		timeout:    3 * time.Second,
+		minRefresh: time.Second,
+		maxRefresh: 30 * time.Second,
+	}
+	for _, o := range opts {
+		o(op)
+	}
+	if op.nameserver == "" {
+		conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, err
+		}
+		if len(conf.Servers) == 0 {
+			return nil, ErrNoNameserver
+		}
+		op.nameserver = net.JoinHostPort(conf.Servers[0], conf.Port)
+	}
+	return &Discovery{
+		opts: op,
+		client: &dns.Client{
+			Timeout: op.timeout,
+		},
+		tcp: &dns.Client{
+			Net:     "tcp",
+			Timeout: op.timeout,
+		},
+	}, nil
+}
+
+// GetService 查询 SRV 记录并返回服务实例
+func (d *Discovery) GetService(ctx context.Context, serviceName string) ([]*register.ServiceInstance, error) {
+	ss, _, err := d.resolve(ctx, serviceName)
+	return ss, err
+}
+
+// Watch 创建观察者, 按记录 TTL 轮询
+func (d *Discovery) Watch(ctx context.Context, serviceName string) (register.Watcher, error) {
+	w := &watcher{
+		serviceName: serviceName,
+		discovery:   d,
+		first:       true,
+	}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	return w, nil
+}
+
+func (d *Discovery) Close() error {
+	return nil
+}
+
+// srvName 生成 SRV 查询名, _grpc._tcp.<service>.<domain>.
+func (d *Discovery) srvName(serviceName string) string {
+	name := fmt.Sprintf("_%s._%s.%s", d.opts.service, d.opts.proto, serviceName)
+	if d.opts.domain != "" {
+		name += "." + strings.Trim(d.opts.domain, ".")
+	}
+	return dns.Fqdn(name)
+}
+
+// refresh 根据 TTL 计算下次轮询间隔
+func (d *Discovery) refresh(ttl uint32) time.Duration {
+	interval := time.Duration(ttl) * time.Second
+	if interval <= 0 || interval > d.opts.maxRefresh {
+		return d.opts.maxRefresh
+	}
+	if interval < d.opts.minRefresh {
+		return d.opts.minRefresh
+	}
+	return interval
+}
+
+func (d *Discovery) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	r, _, err := d.client.ExchangeContext(ctx, m, d.opts.nameserver)
+	if err != nil {
+		return nil, err
+	}
+	// 记录较多时 UDP 响应只包含部分记录, 必须通过 TCP 获取完整结果
+	if r.Truncated {
+		if r, _, err = d.tcp.ExchangeContext(ctx, m, d.opts.nameserver); err != nil {
+			return nil, err
+		}
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("dns: query %s %s failed: %s", name, dns.TypeToString[qtype], dns.RcodeToString[r.Rcode])
+	}
+	return r, nil
+}
+
+// resolve 查询 SRV 及其目标的 A/AAAA 记录, 返回服务实例与最小 TTL
+func (d *Discovery) resolve(ctx context.Context, serviceName string) ([]*register.ServiceInstance, uint32, error) {
+	r, err := d.query(ctx, d.srvName(serviceName), dns.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	var (
+		minTTL uint32
+		extra  = make(map[string][]net.IP)
+	)
+	ttl := func(t uint32) {
+		if minTTL == 0 || t < minTTL {
+			minTTL = t
+		}
+	}
+	// 附加段中已有的地址记录无需再次查询
+	for _, rr := range r.Extra {
+		switch a := rr.(type) {
+		case *dns.A:
+			extra[strings.ToLower(a.Hdr.Name)] = append(extra[strings.ToLower(a.Hdr.Name)], a.A)
+			ttl(a.Hdr.Ttl)
+		case *dns.AAAA:
+			extra[strings.ToLower(a.Hdr.Name)] = append(extra[strings.ToLower(a.Hdr.Name)], a.AAAA)
+			ttl(a.Hdr.Ttl)
+		}
+	}
+	services := make([]*register.ServiceInstance, 0, len(r.Answer))
+	for _, rr := range r.Answer {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+		ttl(srv.Hdr.Ttl)
+		ips, ok := extra[strings.ToLower(srv.Target)]
+		if !ok {
+			var addrTTL uint32
+			if ips, addrTTL, err = d.lookupIP(ctx, srv.Target); err != nil {
+				return nil, 0, err
+			}
+			if len(ips) > 0 {
+				ttl(addrTTL)
+			}
+		}
+		port := strconv.Itoa(int(srv.Port))
+		for _, ip := range ips {
+			addr := net.JoinHostPort(ip.String(), port)
+			services = append(services, &register.ServiceInstance{
+				ID:        addr,
+				Name:      serviceName,
+				Endpoints: []string{fmt.Sprintf("%s://%s", d.opts.scheme, addr)},
+				Metadata: map[string]string{
+					"target":   strings.TrimSuffix(srv.Target, "."),
+					"priority": strconv.Itoa(int(srv.Priority)),
+					"weight":   strconv.Itoa(int(srv.Weight)),
+				},
+			})
+		}
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].ID < services[j].ID
+	})
+	return services, minTTL, nil
+}
+
+// lookupIP 查询目标主机的 A 与 AAAA 记录
+func (d *Discovery) lookupIP(ctx context.Context, target string) ([]net.IP, uint32, error) {
+	var (
+		ips    []net.IP
+		minTTL uint32
+	)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		r, err := d.query(ctx, target, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, rr := range r.Answer {
+			var t uint32
+			switch a := rr.(type) {
+			case *dns.A:
+				ips, t = append(ips, a.A), a.Hdr.Ttl
+			case *dns.AAAA:
+				ips, t = append(ips, a.AAAA), a.Hdr.Ttl
+			default:
+				continue
+			}
+			if minTTL == 0 || t < minTTL {
+				minTTL = t
+			}
+		}
+	}
+	return ips, minTTL, nil
+}
@@ -0,0 +1,183 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/yanglunara/discovery/register"
+)
+
+// zone 进程内 DNS 服务器的记录, 可在测试中修改
+type zone struct {
+	lock     sync.Mutex
+	records  map[uint16][]dns.RR
+	truncate bool // 通过 UDP 查询时只返回第一条记录并设置截断标志
+}
+
+func (z *zone) set(rrs ...string) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	z.records = make(map[uint16][]dns.RR)
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(err)
+		}
+		z.records[rr.Header().Rrtype] = append(z.records[rr.Header().Rrtype], rr)
+	}
+}
+
+func (z *zone) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(r)
+	q := r.Question[0]
+	for _, rr := range z.records[q.Qtype] {
+		if dns.Fqdn(rr.Header().Name) == q.Name {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if len(m.Answer) == 0 && q.Qtype == dns.TypeSRV {
+		m.Rcode = dns.RcodeNameError
+	}
+	if z.truncate && len(m.Answer) > 1 && w.RemoteAddr().Network() == "udp" {
+		m.Answer = m.Answer[:1]
+		m.Truncated = true
+	}
+	_ = w.WriteMsg(m)
+}
+
+// newTestServer 在同一端口上启动 UDP 与 TCP 服务
+func newTestServer(t *testing.T, z *zone) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		_ = pc.Close()
+		t.Fatal(err)
+	}
+	for _, srv := range []*dns.Server{{PacketConn: pc, Handler: z}, {Listener: lis, Handler: z}} {
+		srv := srv
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go func() {
+			_ = srv.ActivateAndServe()
+		}()
+		<-started
+		t.Cleanup(func() {
+			_ = srv.Shutdown()
+		})
+	}
+	return pc.LocalAddr().String()
+}
+
+func TestDiscovery(t *testing.T) {
+	z := &zone{}
+	z.set(
+		"_grpc._tcp.logic.example.com. 1 IN SRV 10 60 9000 node1.example.com.",
+		"_grpc._tcp.logic.example.com. 1 IN SRV 10 40 9001 node2.example.com.",
+		"node1.example.com. 1 IN A 10.0.0.1",
+		"node2.example.com. 1 IN AAAA ::1",
+	)
+	addr := newTestServer(t, z)
+	d, err := NewDiscovery(Nameserver(addr), Domain("example.com"), Refresh(10*time.Millisecond, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	ss, err := d.GetService(ctx, "logic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*register.ServiceInstance{
+		{
+			ID:        "10.0.0.1:9000",
+			Name:      "logic",
+			Endpoints: []string{"grpc://10.0.0.1:9000"},
+			Metadata:  map[string]string{"target": "node1.example.com", "priority": "10", "weight": "60"},
+		},
+		{
+			ID:        "[::1]:9001",
+			Name:      "logic",
+			Endpoints: []string{"grpc://[::1]:9001"},
+			Metadata:  map[string]string{"target": "node2.example.com", "priority": "10", "weight": "40"},
+		},
+	}
+	if len(ss) != len(want) {
+		t.Fatalf("want %d instances, got %+v", len(want), ss)
+	}
+	for i := range want {
+		if ss[i].ID != want[i].ID || ss[i].Endpoints[0] != want[i].Endpoints[0] ||
+			ss[i].Metadata["weight"] != want[i].Metadata["weight"] || ss[i].Metadata["target"] != want[i].Metadata["target"] {
+			t.Fatalf("want %+v, got %+v", want[i], ss[i])
+		}
+	}
+
+	w, err := d.Watch(ctx, "logic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = w.Close()
+	}()
+	if ss, err = w.Next(); err != nil || len(ss) != 2 {
+		t.Fatalf("unexpected first snapshot %v, %v", ss, err)
+	}
+
+	// 记录变更后在 TTL 到期时推送
+	z.set(
+		"_grpc._tcp.logic.example.com. 1 IN SRV 10 60 9000 node1.example.com.",
+		"node1.example.com. 1 IN A 10.0.0.1",
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ss, err = w.Next()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch timeout")
+	}
+	if err != nil || len(ss) != 1 || ss[0].ID != "10.0.0.1:9000" {
+		t.Fatalf("unexpected instances %v, %v", ss, err)
+	}
+
+	// 记录不存在时返回空列表
+	if ss, err = d.GetService(ctx, "missing"); err != nil || len(ss) != 0 {
+		t.Fatalf("expected no instances, got %v, %v", ss, err)
+	}
+}
+
+func TestDiscovery_Truncated(t *testing.T) {
+	z := &zone{truncate: true}
+	z.set(
+		"_grpc._tcp.logic.example.com. 1 IN SRV 10 50 9000 node1.example.com.",
+		"_grpc._tcp.logic.example.com. 1 IN SRV 10 50 9001 node2.example.com.",
+		"_grpc._tcp.logic.example.com. 1 IN SRV 10 50 9002 node3.example.com.",
+		"node1.example.com. 1 IN A 10.0.0.1",
+		"node2.example.com. 1 IN A 10.0.0.2",
+		"node3.example.com. 1 IN A 10.0.0.3",
+	)
+	d, err := NewDiscovery(Nameserver(newTestServer(t, z)), Domain("example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 截断的 UDP 响应只有一条记录, 通过 TCP 重新查询后返回全部实例
+	ss, err := d.GetService(context.Background(), "logic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 3 {
+		t.Fatalf("want 3 instances, got %+v", ss)
+	}
+}
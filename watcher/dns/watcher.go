@@ -0,0 +1,60 @@
+package dns
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/yanglunara/discovery/register"
+)
+
+var (
+	_ register.Watcher = (*watcher)(nil)
+)
+
+type watcher struct {
+	serviceName string
+	discovery   *Discovery
+	first       bool
+	last        []*register.ServiceInstance
+	interval    time.Duration
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+// Next 首次立即查询, 之后按 TTL 轮询, 仅在实例发生变化时返回
+func (w *watcher) Next() ([]*register.ServiceInstance, error) {
+	for {
+		if !w.first {
+			select {
+			case <-w.ctx.Done():
+				return nil, w.ctx.Err()
+			case <-time.After(w.interval):
+			}
+		}
+		ctx, cancel := context.WithTimeout(w.ctx, w.discovery.opts.timeout)
+		ss, ttl, err := w.discovery.resolve(ctx, w.serviceName)
+		cancel()
+		if err != nil {
+			if w.ctx.Err() != nil {
+				return nil, w.ctx.Err()
+			}
+			// 查询失败时按最短间隔重试
+			w.first = false
+			w.interval = w.discovery.opts.minRefresh
+			return nil, err
+		}
+		w.interval = w.discovery.refresh(ttl)
+		if !w.first && reflect.DeepEqual(ss, w.last) {
+			continue
+		}
+		w.first = false
+		w.last = ss
+		return ss, nil
+	}
+}
+
+func (w *watcher) Close() error {
+	w.cancel()
+	return nil
+}
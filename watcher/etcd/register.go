@@ -1,168 +1,258 @@
 package etcd
 
-// import (
-// 	"context"
-// 	"encoding/json"
-// 	"github.com/yanglunara/discovery/register"
-// 	"go.etcd.io/etcd/clientv3"
-// 	"strings"
-// 	"time"
-// )
-
-// var (
-// 	_ register.Registrar = (*Registry)(nil)
-// )
-
-// type Options struct {
-// 	Ctx       context.Context
-// 	Namespace register.Namespace // 命名空间
-// 	Ttl       time.Duration
-// 	MaxRetry  int //最大重试次数
-// }
-
-// type Registry struct {
-// 	*Options
-// 	client *clientv3.Client
-// 	kv     clientv3.KV
-// 	lease  clientv3.Lease
-// 	ctxMap map[*register.ServiceInstance]context.CancelFunc
-// }
-
-// func NewRegistry(client *clientv3.Client, opts *Options) *Registry {
-// 	return &Registry{
-// 		Options: opts,
-// 		client:  client,
-// 		kv:      clientv3.NewKV(client),
-// 		lease:   clientv3.NewLease(client),
-// 		ctxMap:  make(map[*register.ServiceInstance]context.CancelFunc),
-// 	}
-// }
-
-// // withKV 注册数据到etcd
-// func (r *Registry) withKV(ctx context.Context, key string, value string) (id clientv3.LeaseID, err error) {
-// 	var (
-// 		grant *clientv3.LeaseGrantResponse
-// 	)
-// 	if grant, err = r.lease.Grant(ctx, int64(r.Ttl.Seconds())); err != nil {
-// 		return
-// 	}
-// 	if _, err = r.kv.Put(ctx, key, value, clientv3.WithLease(grant.ID)); err != nil {
-// 		return
-// 	}
-// 	return grant.ID, nil
-// }
-
-// // Register 注册服务实例
-// func (r *Registry) Register(ctx context.Context, service *register.ServiceInstance) (err error) {
-// 	var (
-// 		value []byte
-// 	)
-// 	if value, err = json.Marshal(service); err != nil {
-// 		return
-// 	}
-// 	if r.lease != nil {
-// 		defer func() {
-// 			_ = r.lease.Close()
-// 		}()
-// 	}
-// 	// 创建租约
-// 	r.lease = clientv3.NewLease(r.client)
-// 	var (
-// 		leaseID clientv3.LeaseID
-// 		key     string = strings.TrimPrefix(string(r.Namespace)+"/"+service.Name+"/"+service.ID, "/")
-// 	)
-// 	// 注册服务
-// 	if leaseID, err = r.withKV(ctx,
-// 		key,
-// 		string(value)); err != nil {
-// 		return
-// 	}
-// 	hCtx, cancel := context.WithCancel(ctx)
-// 	// 根据服务实例创建一个上下文, 用于取消续租
-// 	r.ctxMap[service] = cancel
-
-// 	go r.heartBeat(hCtx, leaseID, key, string(value))
-// 	return nil
-// }
-
-// func (r *Registry) Deregister(ctx context.Context, service *register.ServiceInstance) (err error) {
-// 	defer func() {
-// 		if r.lease != nil {
-// 			_ = r.lease.Close()
-// 		}
-// 	}()
-// 	// 取消续租
-// 	if cancel, ok := r.ctxMap[service]; ok {
-// 		cancel()
-// 		delete(r.ctxMap, service)
-// 	}
-// 	key := strings.TrimPrefix(string(r.Namespace)+"/"+service.Name+"/"+service.ID, "/")
-// 	if _, err = r.client.Delete(ctx, key); err != nil {
-// 		return
-// 	}
-// 	return nil
-// }
-
-// // heartBeat 续租
-// func (r *Registry) heartBeat(ctx context.Context, leaseID clientv3.LeaseID, key string, value string) {
-// 	curLeaseID := leaseID
-// 	// 续租
-// 	kac, err := r.lease.KeepAlive(ctx, curLeaseID)
-// 	if err != nil {
-// 		curLeaseID = 0
-// 	}
-// 	for {
-// 		if curLeaseID == 0 {
-// 			var arr []int
-// 			for cnt := 0; cnt < r.MaxRetry; cnt++ {
-// 				// 上下文出错 退出当前续租
-// 				if ctx.Err() != nil {
-// 					return
-// 				}
-// 				idChan := make(chan clientv3.LeaseID, 1)
-// 				errChan := make(chan error, 1)
-// 				cancelCtx, cancel := context.WithCancel(ctx)
-// 				go func() {
-// 					defer cancel()
-// 					if id, err := r.withKV(cancelCtx, key, value); err != nil {
-// 						errChan <- err
-// 					} else {
-// 						idChan <- id
-// 					}
-// 				}()
-// 				// 等待续租结果
-// 				select {
-// 				// 3秒超时
-// 				case <-time.After(time.Second * 3):
-// 					cancel()
-// 					continue
-// 				case <-errChan:
-// 					continue
-// 				case curLeaseID = <-idChan:
-// 				}
-// 				kac, err = r.client.KeepAlive(ctx, curLeaseID)
-// 				if err == nil {
-// 					break
-// 				}
-// 				arr = append(arr, 1<<cnt)
-// 				// 重试间隔
-// 				time.Sleep(time.Second * time.Duration(arr[cnt]))
-// 			}
-// 			if _, ok := <-kac; !ok {
-// 				return
-// 			}
-// 		}
-// 		select {
-// 		case _, ok := <-kac:
-// 			if !ok {
-// 				if ctx.Err() != nil {
-// 					return
-// 				}
-// 				curLeaseID = 0
-// 				continue
-// 			}
-// 		case <-r.Ctx.Done():
-// 			return
-// 		}
-// 	}
-// }
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yanglunara/discovery/register"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	_ register.Registrar = (*Registry)(nil)
+	_ register.Discovery = (*Registry)(nil)
+	_ register.Stopper   = (*Registry)(nil)
+	_ register.Scoper    = (*Registry)(nil)
+)
+
+// Option 注册中心选项
+type Option func(o *options)
+
+type options struct {
+	ctx       context.Context
+	namespace string        // 命名空间, 作为 key 前缀
+	ttl       time.Duration // 租约时长
+	maxRetry  int           // 重新注册失败后重试间隔翻倍的次数
+}
+
+// Context 设置注册中心的上下文, 上下文结束后停止续租
+func Context(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+// Namespace 设置命名空间
+func Namespace(ns string) Option {
+	return func(o *options) {
+		o.namespace = ns
+	}
+}
+
+// RegisterTTL 设置租约时长
+func RegisterTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.ttl = ttl
+	}
+}
+
+// MaxRetry 设置重新注册失败后重试间隔翻倍的次数, 之后按最大间隔持续重试直到上下文结束
+func MaxRetry(num int) Option {
+	return func(o *options) {
+		o.maxRetry = num
+	}
+}
+
+type Registry struct {
+	opts   *options
+	client *clientv3.Client
+	kv     clientv3.KV
+	lease  clientv3.Lease
+	lock   sync.Mutex
+	ctxMap map[string]context.CancelFunc // 服务实例 key 对应的续租取消函数
+}
+
+func NewRegistry(client *clientv3.Client, opts ...Option) *Registry {
+	op := &options{
+		ctx:       context.Background(),
+		namespace: "/microservices",
+		ttl:       15 * time.Second,
+		maxRetry:  5,
+	}
+	for _, o := range opts {
+		o(op)
+	}
+	return &Registry{
+		opts:   op,
+		client: client,
+		kv:     clientv3.NewKV(client),
+		lease:  clientv3.NewLease(client),
+		ctxMap: make(map[string]context.CancelFunc),
+	}
+}
+
+func (r *Registry) serviceKey(name, id string) string {
+	return fmt.Sprintf("%s/%s/%s", r.opts.namespace, name, id)
+}
+
+func (r *Registry) servicePrefix(name string) string {
+	return fmt.Sprintf("%s/%s/", r.opts.namespace, name)
+}
+
+// Register 注册服务实例
+func (r *Registry) Register(ctx context.Context, service *register.ServiceInstance) (err error) {
+	var (
+		value   []byte
+		leaseID clientv3.LeaseID
+		key     = r.serviceKey(service.Name, service.ID)
+	)
+	if value, err = json.Marshal(service); err != nil {
+		return
+	}
+	if leaseID, err = r.withKV(ctx, key, string(value)); err != nil {
+		return
+	}
+	hCtx, cancel := context.WithCancel(r.opts.ctx)
+	r.lock.Lock()
+	// 同一实例重复注册时, 停止旧的续租
+	if old, ok := r.ctxMap[key]; ok {
+		old()
+	}
+	r.ctxMap[key] = cancel
+	r.lock.Unlock()
+
+	go r.heartBeat(hCtx, leaseID, key, string(value))
+	return nil
+}
+
+// Deregister 注销服务实例
+func (r *Registry) Deregister(ctx context.Context, service *register.ServiceInstance) error {
+	key := r.serviceKey(service.Name, service.ID)
+	r.lock.Lock()
+	// 取消续租
+	if cancel, ok := r.ctxMap[key]; ok {
+		cancel()
+		delete(r.ctxMap, key)
+	}
+	r.lock.Unlock()
+	_, err := r.client.Delete(ctx, key)
+	return err
+}
+
+// GetService 根据服务名称获取服务实例
+func (r *Registry) GetService(ctx context.Context, serviceName string) ([]*register.ServiceInstance, error) {
+	resp, err := r.kv.Get(ctx, r.servicePrefix(serviceName), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*register.ServiceInstance, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		si := new(register.ServiceInstance)
+		if err := json.Unmarshal(kv.Value, si); err != nil {
+			return nil, err
+		}
+		if si.Name != serviceName {
+			continue
+		}
+		items = append(items, si)
+	}
+	return items, nil
+}
+
+// Watch 根据服务名称创建观察者
+func (r *Registry) Watch(ctx context.Context, serviceName string) (register.Watcher, error) {
+	return newWatcher(ctx, r.servicePrefix(serviceName), serviceName, r.client)
+}
+
+// Close 停止所有续租并删除已注册的服务实例
+func (r *Registry) Close() error {
+	r.lock.Lock()
+	keys := make([]string, 0, len(r.ctxMap))
+	for key, cancel := range r.ctxMap {
+		cancel()
+		keys = append(keys, key)
+	}
+	r.ctxMap = make(map[string]context.CancelFunc)
+	r.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	for _, key := range keys {
+		_, _ = r.client.Delete(ctx, key)
+	}
+	return r.lease.Close()
+}
+
+// Scope 返回以 authority 为命名空间的服务发现, 与原注册中心共用 etcd 客户端
+func (r *Registry) Scope(authority string) (register.Discovery, error) {
+	if authority == "" {
+		return nil, fmt.Errorf("etcd: empty authority")
+	}
+	op := *r.opts
+	op.namespace = "/" + strings.Trim(authority, "/")
+	return &Registry{
+		opts:   &op,
+		client: r.client,
+		kv:     clientv3.NewKV(r.client),
+		lease:  clientv3.NewLease(r.client),
+		ctxMap: make(map[string]context.CancelFunc),
+	}, nil
+}
+
+// withKV 创建租约并写入数据
+func (r *Registry) withKV(ctx context.Context, key string, value string) (clientv3.LeaseID, error) {
+	grant, err := r.lease.Grant(ctx, int64(r.opts.ttl.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+	if _, err = r.kv.Put(ctx, key, value, clientv3.WithLease(grant.ID)); err != nil {
+		return 0, err
+	}
+	return grant.ID, nil
+}
+
+// heartBeat 续租, 租约丢失后重新注册; 重新注册失败时按指数退避持续重试直到上下文结束,
+// 避免 etcd 长时间不可用后实例永久丢失
+func (r *Registry) heartBeat(ctx context.Context, leaseID clientv3.LeaseID, key string, value string) {
+	curLeaseID := leaseID
+	kac, err := r.lease.KeepAlive(ctx, curLeaseID)
+	if err != nil {
+		curLeaseID = 0
+	}
+	retry := 0
+	for {
+		if curLeaseID == 0 {
+			// 上下文出错 退出当前续租
+			if ctx.Err() != nil {
+				return
+			}
+			outCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+			id, err := r.withKV(outCtx, key, value)
+			cancel()
+			if err == nil {
+				if kac, err = r.lease.KeepAlive(ctx, id); err == nil {
+					curLeaseID = id
+					retry = 0
+					continue
+				}
+			}
+			// 重试间隔, 翻倍 maxRetry 次后保持不变
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second << retry):
+			}
+			if retry < r.opts.maxRetry {
+				retry++
+			}
+			continue
+		}
+		select {
+		case _, ok := <-kac:
+			if !ok {
+				if ctx.Err() != nil {
+					return
+				}
+				// 租约丢失, 重新注册
+				curLeaseID = 0
+				continue
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -1,91 +1,192 @@
 package etcd
 
-// import (
-// 	"context"
-// 	"github.com/yanglunara/discovery/register"
-// 	"go.etcd.io/etcd/clientv3"
-// 	"google.golang.org/grpc"
-// 	"os"
-// 	"testing"
-// 	"time"
-// )
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
 
-// func TestHeartBeat(t *testing.T) {
-// 	client, err := clientv3.New(clientv3.Config{
-// 		Endpoints:   []string{"127.0.0.1:2379"},
-// 		DialTimeout: time.Second, DialOptions: []grpc.DialOption{grpc.WithBlock()},
-// 	})
-// 	if err != nil {
-// 		t.Fatal(err)
-// 	}
-// 	defer func() {
-// 		_ = client.Close()
-// 	}()
+	"github.com/yanglunara/discovery/register"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
 
-// 	ctx := context.Background()
-// 	id, _ := os.Hostname()
-// 	s := &register.ServiceInstance{
-// 		ID:      id,
-// 		Name:    "helloworld",
-// 		Version: "v1.0",
-// 	}
-// 	opts := &Options{
-// 		Ctx:       ctx,
-// 		MaxRetry:  5,
-// 		Ttl:       2 * time.Second,
-// 		Namespace: "microservices",
-// 	}
-// 	go func() {
-// 		//r := NewRegistry(client, opts)
-// 		//w, err1 := r.Watch(ctx, s.Name)
-// 		//if err1 != nil {
-// 		//	return
-// 		//}
-// 		//defer func() {
-// 		//	_ = w.Stop()
-// 		//}()
-// 		//for {
-// 		//	res, err2 := w.Next()
-// 		//	if err2 != nil {
-// 		//		return
-// 		//	}
-// 		//	t.Logf("watch: %d", len(res))
-// 		//	for _, r := range res {
-// 		//		t.Logf("next: %+v", r)
-// 		//	}
-// 		//}
-// 	}()
-// 	time.Sleep(time.Second)
+func newTestClient(t *testing.T) *clientv3.Client {
+	t.Helper()
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientURL, _ := url.Parse("http://127.0.0.1:0")
+	peerURL, _ := url.Parse("http://127.0.0.1:0")
+	cfg.ListenClientUrls = []url.URL{*clientURL}
+	cfg.ListenPeerUrls = []url.URL{*peerURL}
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("start etcd failed: %v", err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("etcd server took too long to start")
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{e.Clients[0].Addr().String()},
+		DialTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("create etcd client failed: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return client
+}
 
-// 	// new a server
-// 	r := NewRegistry(client, opts)
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	r := NewRegistry(client, Namespace("/test"), RegisterTTL(2*time.Second))
+	defer func() {
+		_ = r.Close()
+	}()
 
-// 	//key := fmt.Sprintf("%s/%s/%s", r.Namespace, s.Name, s.ID)
-// 	//value, _ := json.Marshal(s)
-// 	//r.lease = clientv3.NewLease(r.client)
-// 	_ = r.Register(ctx, s)
-// 	//_, _ = r.withKV(ctx, key, string(value))
-// 	//if err != nil {
-// 	//	t.Fatal(err)
-// 	//}
-// 	//go r.heartBeat(ctx, leaseID, key, string(value))
-// 	// wait for lease expired
-// 	time.Sleep(10 * time.Second)
+	w, err := r.Watch(ctx, "helloworld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = w.Close()
+	}()
+	// 首次调用返回当前快照
+	if res, err := w.Next(); err != nil || len(res) != 0 {
+		t.Fatalf("expected empty snapshot, got %v, %v", res, err)
+	}
 
-// 	//res, err := r.GetService(ctx, s.Name)
-// 	//if err != nil {
-// 	//	t.Fatal(err)
-// 	//}
-// 	//if len(res) != 0 {
-// 	//	t.Errorf("not expected empty")
-// 	//}
+	s := &register.ServiceInstance{
+		ID:        "1",
+		Name:      "helloworld",
+		Version:   "v1.0.0",
+		Endpoints: []string{"grpc://127.0.0.1:9000"},
+	}
+	if err = r.Register(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	res, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].ID != s.ID || res[0].Endpoints[0] != s.Endpoints[0] {
+		t.Fatalf("watch got %+v", res)
+	}
 
-// 	//time.Sleep(time.Second * 30)
-// 	//res, err = r.GetService(ctx, s.Name)
-// 	//if err != nil {
-// 	//	t.Fatal(err)
-// 	//}
-// 	//if len(res) == 0 {
-// 	//	t.Errorf("reconnect failed")
-// 	//}
-// }
+	// 超过租约时长后续租仍然生效
+	time.Sleep(3 * time.Second)
+	if res, err = r.GetService(ctx, s.Name); err != nil || len(res) != 1 {
+		t.Fatalf("expected registered instance after ttl, got %v, %v", res, err)
+	}
+
+	if err = r.Deregister(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = w.Next(); err != nil || len(res) != 0 {
+		t.Fatalf("expected empty after deregister, got %v, %v", res, err)
+	}
+}
+
+func TestRegistry_Close(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	r := NewRegistry(client)
+	for i := 0; i < 3; i++ {
+		err := r.Register(ctx, &register.ServiceInstance{
+			ID:        fmt.Sprintf("%d", i),
+			Name:      "helloworld",
+			Endpoints: []string{fmt.Sprintf("grpc://127.0.0.1:900%d", i)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := NewRegistry(client).GetService(ctx, "helloworld")
+	if err != nil || len(res) != 3 {
+		t.Fatalf("expected 3 instances, got %v, %v", res, err)
+	}
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = NewRegistry(client).GetService(ctx, "helloworld"); err != nil || len(res) != 0 {
+		t.Fatalf("expected no instances after close, got %v, %v", res, err)
+	}
+}
+
+func TestRegistry_Scope(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	_ = NewRegistry(client).Register(ctx, &register.ServiceInstance{ID: "1", Name: "helloworld", Endpoints: []string{"grpc://127.0.0.1:9000"}})
+	_ = NewRegistry(client, Namespace("/payments")).Register(ctx, &register.ServiceInstance{ID: "2", Name: "helloworld", Endpoints: []string{"grpc://127.0.0.1:9001"}})
+
+	d, err := NewRegistry(client).Scope("payments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := d.GetService(ctx, "helloworld")
+	if err != nil || len(res) != 1 || res[0].ID != "2" {
+		t.Fatalf("expected instance in scoped namespace, got %v, %v", res, err)
+	}
+	if _, err = NewRegistry(client).Scope(""); err == nil {
+		t.Fatal("expected error for empty authority")
+	}
+}
+
+// flakyLease 前 fail 次创建租约失败, 模拟 etcd 不可用
+type flakyLease struct {
+	clientv3.Lease
+	fail atomic.Int32
+}
+
+func (l *flakyLease) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	if l.fail.Add(-1) >= 0 {
+		return nil, errors.New("etcd unavailable")
+	}
+	return l.Lease.Grant(ctx, ttl)
+}
+
+func TestRegistry_Reregister(t *testing.T) {
+	ctx := context.Background()
+	client := newTestClient(t)
+	r := NewRegistry(client, Namespace("/test"), MaxRetry(0))
+	lease := &flakyLease{Lease: r.lease}
+	r.lease = lease
+	defer func() {
+		_ = r.Close()
+	}()
+	s := &register.ServiceInstance{ID: "1", Name: "helloworld", Endpoints: []string{"grpc://127.0.0.1:9000"}}
+	if err := r.Register(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(ctx, r.serviceKey(s.Name, s.ID))
+	if err != nil || len(resp.Kvs) != 1 {
+		t.Fatalf("expected registered key, got %v, %v", resp, err)
+	}
+
+	// 租约丢失后, 重新注册连续失败超过 MaxRetry 次仍继续重试
+	lease.fail.Store(3)
+	if _, err = client.Revoke(ctx, clientv3.LeaseID(resp.Kvs[0].Lease)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if res, _ := r.GetService(ctx, s.Name); len(res) == 1 {
+			if lease.fail.Load() >= 0 {
+				t.Fatal("expected re-registration after failures")
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("instance not re-registered")
+}
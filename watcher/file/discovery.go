@@ -0,0 +1,245 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/yanglunara/discovery/register"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	_ register.Discovery = (*Discovery)(nil)
+
+	ErrClosed = errors.New("file discovery closed")
+)
+
+// Option 文件服务发现选项
+type Option func(o *options)
+
+type options struct {
+	delay   time.Duration   // 文件变更后延迟加载, 合并编辑器的多次写入
+	onError func(err error) // 重新加载失败时回调, 此时继续使用上一次的配置
+}
+
+// ReloadDelay 设置文件变更后的延迟加载时间
+func ReloadDelay(delay time.Duration) Option {
+	return func(o *options) {
+		o.delay = delay
+	}
+}
+
+// OnError 设置重新加载失败时的回调
+func OnError(fn func(err error)) Option {
+	return func(o *options) {
+		o.onError = fn
+	}
+}
+
+// Discovery 基于 JSON/YAML 文件的服务发现, 文件内容为 register.ServiceInstance 列表
+type Discovery struct {
+	opts     *options
+	path     string
+	resolved string // path 解析符号链接后的实际文件, 仅在 run 中访问
+	fsw      *fsnotify.Watcher
+	lock     sync.RWMutex
+	services map[string][]*register.ServiceInstance // 服务名 -> 实例
+	watchers map[string]map[*watcher]struct{}       // 服务名 -> 观察者
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+func NewDiscovery(path string, opts ...Option) (*Discovery, error) {
+	op := &options{
+		delay:   100 * time.Millisecond,
+		onError: func(error) {},
+	}
+	for _, o := range opts {
+		o(op)
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &Discovery{
+		opts:     op,
+		path:     path,
+		watchers: make(map[string]map[*watcher]struct{}),
+	}
+	if d.services, err = load(path); err != nil {
+		return nil, err
+	}
+	if d.resolved, err = filepath.EvalSymlinks(path); err != nil {
+		return nil, err
+	}
+	if d.fsw, err = fsnotify.NewWatcher(); err != nil {
+		return nil, err
+	}
+	// 监听所在目录, 编辑器通过重命名替换文件时也能感知
+	if err = d.fsw.Add(filepath.Dir(path)); err != nil {
+		_ = d.fsw.Close()
+		return nil, err
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	go d.run()
+	return d, nil
+}
+
+// GetService 获取服务实例
+func (d *Discovery) GetService(_ context.Context, serviceName string) ([]*register.ServiceInstance, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if d.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+	return append([]*register.ServiceInstance(nil), d.services[serviceName]...), nil
+}
+
+// Watch 创建观察者, 首次 Next 返回当前快照
+func (d *Discovery) Watch(ctx context.Context, serviceName string) (register.Watcher, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+	w := &watcher{
+		serviceName: serviceName,
+		discovery:   d,
+		event:       make(chan struct{}, 1),
+	}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	set, ok := d.watchers[serviceName]
+	if !ok {
+		set = make(map[*watcher]struct{})
+		d.watchers[serviceName] = set
+	}
+	set[w] = struct{}{}
+	w.event <- struct{}{}
+	return w, nil
+}
+
+// Close 停止监听文件, 所有观察者返回 ErrClosed
+func (d *Discovery) Close() error {
+	d.cancel()
+	return d.fsw.Close()
+}
+
+func (d *Discovery) run() {
+	var (
+		timer *time.Timer
+		fire  <-chan time.Time
+	)
+	for {
+		select {
+		case <-d.ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case ev, ok := <-d.fsw.Events:
+			if !ok {
+				return
+			}
+			if !d.changed(ev) {
+				continue
+			}
+			if timer == nil {
+				timer = time.NewTimer(d.opts.delay)
+			} else {
+				timer.Reset(d.opts.delay)
+			}
+			fire = timer.C
+		case err, ok := <-d.fsw.Errors:
+			if !ok {
+				return
+			}
+			d.opts.onError(err)
+		case <-fire:
+			fire = nil
+			d.reload()
+		}
+	}
+}
+
+// changed 判断目录中的事件是否影响 path. kubernetes 的 ConfigMap 挂载通过替换 ..data 符号链接更新,
+// 事件中不会出现 path 本身, 因此每次事件都重新解析 path 指向的实际文件
+func (d *Discovery) changed(ev fsnotify.Event) bool {
+	if filepath.Clean(ev.Name) == d.path {
+		return true
+	}
+	resolved, err := filepath.EvalSymlinks(d.path)
+	if err != nil || resolved == d.resolved {
+		// 替换过程中链接可能暂时失效, 等待后续事件
+		return false
+	}
+	d.resolved = resolved
+	return true
+}
+
+// reload 重新加载文件, 仅通知实例发生变化的服务
+func (d *Discovery) reload() {
+	services, err := load(d.path)
+	if err != nil {
+		// 文件被删除或内容不合法时保留上一次的配置
+		d.opts.onError(err)
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	old := d.services
+	d.services = services
+	for name, set := range d.watchers {
+		if reflect.DeepEqual(old[name], services[name]) {
+			continue
+		}
+		for w := range set {
+			select {
+			case w.event <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (d *Discovery) unwatch(w *watcher) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if set, ok := d.watchers[w.serviceName]; ok {
+		delete(set, w)
+		if len(set) == 0 {
+			delete(d.watchers, w.serviceName)
+		}
+	}
+}
+
+// load 读取文件并按服务名分组, JSON 与 YAML 均使用 register.ServiceInstance 的 json 标签
+func load(path string) (map[string][]*register.ServiceInstance, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []*register.ServiceInstance
+	if err = yaml.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	services := make(map[string][]*register.ServiceInstance)
+	for _, in := range list {
+		if in == nil || in.Name == "" {
+			continue
+		}
+		services[in.Name] = append(services[in.Name], in)
+	}
+	for _, ss := range services {
+		sort.SliceStable(ss, func(i, j int) bool {
+			return ss[i].ID < ss[j].ID
+		})
+	}
+	return services, nil
+}
@@ -0,0 +1,180 @@
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yanglunara/discovery/register"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	// 先写临时文件再重命名, 模拟编辑器的原子替换
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func next(t *testing.T, w register.Watcher) []*register.ServiceInstance {
+	t.Helper()
+	ch := make(chan []*register.ServiceInstance, 1)
+	go func() {
+		ss, err := w.Next()
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- ss
+	}()
+	select {
+	case ss := <-ch:
+		return ss
+	case <-time.After(3 * time.Second):
+		t.Fatal("next timeout")
+	}
+	return nil
+}
+
+func TestDiscovery(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		initial string
+		updated string
+	}{
+		{
+			name: "json",
+			file: "services.json",
+			initial: `[
+				{"id": "1", "name": "helloworld", "version": "v1", "endpoints": ["grpc://127.0.0.1:9000"]},
+				{"id": "2", "name": "other", "endpoints": ["grpc://127.0.0.1:9100"]}
+			]`,
+			updated: `[
+				{"id": "1", "name": "helloworld", "version": "v1", "endpoints": ["grpc://127.0.0.1:9000"]},
+				{"id": "3", "name": "helloworld", "version": "v2", "metadata": {"dc": "sh"}, "endpoints": ["grpc://127.0.0.1:9001"]},
+				{"id": "2", "name": "other", "endpoints": ["grpc://127.0.0.1:9100"]}
+			]`,
+		},
+		{
+			name: "yaml",
+			file: "services.yaml",
+			initial: `
+- id: "1"
+  name: helloworld
+  version: v1
+  endpoints: ["grpc://127.0.0.1:9000"]
+- id: "2"
+  name: other
+  endpoints: ["grpc://127.0.0.1:9100"]
+`,
+			updated: `
+- id: "1"
+  name: helloworld
+  version: v1
+  endpoints: ["grpc://127.0.0.1:9000"]
+- id: "3"
+  name: helloworld
+  version: v2
+  metadata:
+    dc: sh
+  endpoints: ["grpc://127.0.0.1:9001"]
+- id: "2"
+  name: other
+  endpoints: ["grpc://127.0.0.1:9100"]
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			path := filepath.Join(t.TempDir(), tt.file)
+			writeFile(t, path, tt.initial)
+			d, err := NewDiscovery(path, ReloadDelay(10*time.Millisecond))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = d.Close()
+			}()
+			w, err := d.Watch(ctx, "helloworld")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ss := next(t, w); len(ss) != 1 || ss[0].ID != "1" || ss[0].Version != "v1" {
+				t.Fatalf("unexpected initial instances %+v", ss)
+			}
+
+			writeFile(t, path, tt.updated)
+			ss := next(t, w)
+			if len(ss) != 2 || ss[1].ID != "3" || ss[1].Metadata["dc"] != "sh" {
+				t.Fatalf("unexpected reloaded instances %+v", ss)
+			}
+
+			// 内容不合法时保留上一次的配置
+			writeFile(t, path, "{")
+			time.Sleep(100 * time.Millisecond)
+			if ss, err = d.GetService(ctx, "helloworld"); err != nil || len(ss) != 2 {
+				t.Fatalf("expected previous instances, got %v, %v", ss, err)
+			}
+
+			_ = d.Close()
+			if _, err = w.Next(); err == nil {
+				t.Fatal("expected error after close")
+			}
+		})
+	}
+}
+
+// swapConfigMap 模拟 kubernetes ConfigMap 的更新: 写入新的数据目录后原子替换 ..data 链接
+func swapConfigMap(t *testing.T, dir, version, file, content string) {
+	t.Helper()
+	data := filepath.Join(dir, version)
+	if err := os.Mkdir(data, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(data, file), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(version, tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiscovery_ConfigMap(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	swapConfigMap(t, dir, "..2024_01", "services.json", `[{"id": "1", "name": "helloworld", "endpoints": ["grpc://127.0.0.1:9000"]}]`)
+	path := filepath.Join(dir, "services.json")
+	if err := os.Symlink(filepath.Join("..data", "services.json"), path); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDiscovery(path, ReloadDelay(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	w, err := d.Watch(ctx, "helloworld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss := next(t, w); len(ss) != 1 || ss[0].ID != "1" {
+		t.Fatalf("unexpected initial instances %+v", ss)
+	}
+
+	swapConfigMap(t, dir, "..2024_02", "services.json", `[{"id": "2", "name": "helloworld", "endpoints": ["grpc://127.0.0.1:9001"]}]`)
+	if ss := next(t, w); len(ss) != 1 || ss[0].ID != "2" {
+		t.Fatalf("unexpected reloaded instances %+v", ss)
+	}
+}
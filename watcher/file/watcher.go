@@ -0,0 +1,36 @@
+package file
+
+import (
+	"context"
+
+	"github.com/yanglunara/discovery/register"
+)
+
+var (
+	_ register.Watcher = (*watcher)(nil)
+)
+
+type watcher struct {
+	serviceName string
+	discovery   *Discovery
+	event       chan struct{}
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+func (w *watcher) Next() ([]*register.ServiceInstance, error) {
+	select {
+	case <-w.ctx.Done():
+		return nil, w.ctx.Err()
+	case <-w.discovery.ctx.Done():
+		return nil, ErrClosed
+	case <-w.event:
+	}
+	return w.discovery.GetService(w.ctx, w.serviceName)
+}
+
+func (w *watcher) Close() error {
+	w.cancel()
+	w.discovery.unwatch(w)
+	return nil
+}
@@ -0,0 +1,364 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yanglunara/discovery/register"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	listersdiscoveryv1 "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	_ register.Discovery = (*Discovery)(nil)
+
+	ErrClosed = errors.New("kubernetes discovery closed")
+)
+
+// 写入 ServiceInstance.Metadata 的拓扑信息
+const (
+	MetadataZone      = "zone"
+	MetadataNode      = "node"
+	MetadataNamespace = "namespace"
+	MetadataPod       = "pod"
+)
+
+// 不写入元数据的注解
+var ignoredAnnotations = map[string]struct{}{
+	corev1.LastAppliedConfigAnnotation: {},
+}
+
+// Option 服务发现选项
+type Option func(o *options)
+
+type options struct {
+	namespace    string
+	resync       time.Duration
+	versionLabel string // 作为 ServiceInstance.Version 的 Pod 标签
+}
+
+// Namespace 设置监听的命名空间
+func Namespace(ns string) Option {
+	return func(o *options) {
+		o.namespace = ns
+	}
+}
+
+// ResyncPeriod 设置 informer 的重新同步周期
+func ResyncPeriod(d time.Duration) Option {
+	return func(o *options) {
+		o.resync = d
+	}
+}
+
+// VersionLabel 设置作为服务版本的 Pod 标签
+func VersionLabel(label string) Option {
+	return func(o *options) {
+		o.versionLabel = label
+	}
+}
+
+// Discovery 基于 EndpointSlice 的服务发现
+type Discovery struct {
+	opts      *options
+	factory   informers.SharedInformerFactory
+	slices    listersdiscoveryv1.EndpointSliceLister
+	pods      listerscorev1.PodLister
+	hasSynced []cache.InformerSynced
+	lock      sync.Mutex
+	watchers  map[string]map[*watcher]struct{} // 服务名 -> 观察者
+	stopCh    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewDiscovery(client kubernetes.Interface, opts ...Option) (*Discovery, error) {
+	op := &options{
+		namespace:    corev1.NamespaceDefault,
+		resync:       5 * time.Minute,
+		versionLabel: "app.kubernetes.io/version",
+	}
+	for _, o := range opts {
+		o(op)
+	}
+	d := &Discovery{
+		opts:     op,
+		factory:  informers.NewSharedInformerFactoryWithOptions(client, op.resync, informers.WithNamespace(op.namespace)),
+		watchers: make(map[string]map[*watcher]struct{}),
+		stopCh:   make(chan struct{}),
+	}
+	sliceInformer := d.factory.Discovery().V1().EndpointSlices()
+	podInformer := d.factory.Core().V1().Pods()
+	d.slices = sliceInformer.Lister()
+	d.pods = podInformer.Lister()
+	if _, err := sliceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    d.onSlice,
+		UpdateFunc: func(_, obj interface{}) { d.onSlice(obj) },
+		DeleteFunc: d.onSlice,
+	}); err != nil {
+		return nil, err
+	}
+	// Pod 标签与注解变化时通知所有服务
+	if _, err := podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { d.notifyAll() },
+		UpdateFunc: func(_, _ interface{}) { d.notifyAll() },
+	}); err != nil {
+		return nil, err
+	}
+	d.hasSynced = []cache.InformerSynced{
+		sliceInformer.Informer().HasSynced,
+		podInformer.Informer().HasSynced,
+	}
+	d.factory.Start(d.stopCh)
+	return d, nil
+}
+
+// GetService 获取服务的就绪实例
+func (d *Discovery) GetService(ctx context.Context, serviceName string) ([]*register.ServiceInstance, error) {
+	if err := d.waitForSync(ctx); err != nil {
+		return nil, err
+	}
+	return d.instances(serviceName)
+}
+
+// Watch 创建观察者, 首次 Next 返回当前快照
+func (d *Discovery) Watch(ctx context.Context, serviceName string) (register.Watcher, error) {
+	if err := d.waitForSync(ctx); err != nil {
+		return nil, err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	select {
+	case <-d.stopCh:
+		return nil, ErrClosed
+	default:
+	}
+	w := &watcher{
+		serviceName: serviceName,
+		discovery:   d,
+		event:       make(chan struct{}, 1),
+		first:       true,
+	}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	set, ok := d.watchers[serviceName]
+	if !ok {
+		set = make(map[*watcher]struct{})
+		d.watchers[serviceName] = set
+	}
+	set[w] = struct{}{}
+	w.event <- struct{}{}
+	return w, nil
+}
+
+// Close 停止所有 informer
+func (d *Discovery) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.stopCh)
+		d.factory.Shutdown()
+	})
+	return nil
+}
+
+func (d *Discovery) waitForSync(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-d.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if !cache.WaitForCacheSync(ctx.Done(), d.hasSynced...) {
+		select {
+		case <-d.stopCh:
+			return ErrClosed
+		default:
+		}
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (d *Discovery) onSlice(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return
+	}
+	d.notify(slice.Labels[discoveryv1.LabelServiceName])
+}
+
+func (d *Discovery) notify(serviceName string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for w := range d.watchers[serviceName] {
+		select {
+		case w.event <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (d *Discovery) notifyAll() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, set := range d.watchers {
+		for w := range set {
+			select {
+			case w.event <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (d *Discovery) unwatch(w *watcher) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if set, ok := d.watchers[w.serviceName]; ok {
+		delete(set, w)
+		if len(set) == 0 {
+			delete(d.watchers, w.serviceName)
+		}
+	}
+}
+
+// instances 将服务的 EndpointSlice 转换为服务实例, 仅保留就绪的端点
+func (d *Discovery) instances(serviceName string) ([]*register.ServiceInstance, error) {
+	selector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: serviceName})
+	slices, err := d.slices.EndpointSlices(d.opts.namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]*register.ServiceInstance)
+	for _, slice := range slices {
+		if slice.AddressType == discoveryv1.AddressTypeFQDN {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			// 未设置 ready 时视为就绪
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			if len(ep.Addresses) == 0 {
+				continue
+			}
+			// 同一端点的多个地址可互相替代, 只使用第一个
+			addr := ep.Addresses[0]
+			ins := &register.ServiceInstance{
+				ID:        addr,
+				Name:      serviceName,
+				Metadata:  map[string]string{MetadataNamespace: slice.Namespace},
+				Endpoints: endpoints(addr, slice.Ports),
+			}
+			if ep.Zone != nil {
+				ins.Metadata[MetadataZone] = *ep.Zone
+			}
+			if ep.NodeName != nil {
+				ins.Metadata[MetadataNode] = *ep.NodeName
+			}
+			if ref := ep.TargetRef; ref != nil && ref.Kind == "Pod" {
+				ins.ID = ref.Name
+				ins.Metadata[MetadataPod] = ref.Name
+				if pod, err := d.pods.Pods(ref.Namespace).Get(ref.Name); err == nil {
+					d.podMetadata(ins, pod)
+				}
+			}
+			if _, ok := seen[ins.ID]; ok {
+				continue
+			}
+			seen[ins.ID] = ins
+		}
+	}
+	services := make([]*register.ServiceInstance, 0, len(seen))
+	for _, ins := range seen {
+		services = append(services, ins)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].ID < services[j].ID
+	})
+	return services, nil
+}
+
+// podMetadata 将 Pod 标签与注解写入元数据, 不覆盖拓扑信息
+func (d *Discovery) podMetadata(ins *register.ServiceInstance, pod *corev1.Pod) {
+	ins.Version = pod.Labels[d.opts.versionLabel]
+	for k, v := range pod.Labels {
+		if _, ok := ins.Metadata[k]; !ok {
+			ins.Metadata[k] = v
+		}
+	}
+	for k, v := range pod.Annotations {
+		if _, ok := ignoredAnnotations[k]; ok {
+			continue
+		}
+		if _, ok := ins.Metadata[k]; !ok {
+			ins.Metadata[k] = v
+		}
+	}
+	if ins.LastTs == 0 {
+		ins.LastTs = pod.CreationTimestamp.UnixNano()
+	}
+}
+
+// appProtocols kubernetes 标准 appProtocol 对应的端点 scheme
+var appProtocols = map[string]string{
+	"kubernetes.io/h2c": "grpc",
+	"kubernetes.io/ws":  "ws",
+	"kubernetes.io/wss": "wss",
+}
+
+// endpoints 根据端口名称或 appProtocol 生成端点, 未命名的端口使用 grpc
+func endpoints(addr string, ports []discoveryv1.EndpointPort) []string {
+	out := make([]string, 0, len(ports))
+	for _, p := range ports {
+		if p.Port == nil {
+			continue
+		}
+		out = append(out, fmt.Sprintf("%s://%s", portScheme(p), net.JoinHostPort(addr, strconv.Itoa(int(*p.Port)))))
+	}
+	return out
+}
+
+// portScheme 优先使用 appProtocol, 带域名前缀的自定义协议无法作为 scheme, 此时回退到端口名称
+func portScheme(p discoveryv1.EndpointPort) string {
+	if p.AppProtocol != nil {
+		if scheme, ok := appProtocols[*p.AppProtocol]; ok {
+			return scheme
+		}
+		if validScheme(*p.AppProtocol) {
+			return *p.AppProtocol
+		}
+	}
+	if p.Name != nil && validScheme(*p.Name) {
+		return *p.Name
+	}
+	return "grpc"
+}
+
+// validScheme 按 RFC 3986 校验 scheme: 字母开头, 仅包含字母、数字、+、-、.
+func validScheme(s string) bool {
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i > 0 && (c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,160 @@
+package kubernetes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/yanglunara/discovery/register"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func newSlice(ready bool) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "logic-abc",
+			Namespace: "im",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "logic"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports: []discoveryv1.EndpointPort{
+			{Name: ptr("grpc"), Port: ptr[int32](9000)},
+			{Name: ptr("http"), Port: ptr[int32](8000)},
+		},
+		Endpoints: []discoveryv1.Endpoint{
+			{
+				Addresses:  []string{"10.0.0.1"},
+				Conditions: discoveryv1.EndpointConditions{Ready: ptr(true)},
+				TargetRef:  &corev1.ObjectReference{Kind: "Pod", Namespace: "im", Name: "logic-0"},
+				Zone:       ptr("sh-a"),
+				NodeName:   ptr("node-1"),
+			},
+			{
+				Addresses:  []string{"10.0.0.2"},
+				Conditions: discoveryv1.EndpointConditions{Ready: ptr(ready)},
+				TargetRef:  &corev1.ObjectReference{Kind: "Pod", Namespace: "im", Name: "logic-1"},
+			},
+		},
+	}
+}
+
+func newPod(name string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "im",
+			Labels: map[string]string{
+				"app":                       "logic",
+				"app.kubernetes.io/version": "v1.2.0",
+			},
+			Annotations: map[string]string{
+				"weight":                           "10",
+				corev1.LastAppliedConfigAnnotation: "{}",
+			},
+		},
+	}
+}
+
+func next(t *testing.T, w register.Watcher) []*register.ServiceInstance {
+	t.Helper()
+	ch := make(chan []*register.ServiceInstance, 1)
+	go func() {
+		ss, err := w.Next()
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- ss
+	}()
+	select {
+	case ss := <-ch:
+		return ss
+	case <-time.After(5 * time.Second):
+		t.Fatal("next timeout")
+	}
+	return nil
+}
+
+func TestDiscovery(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(newSlice(true), newPod("logic-0"), newPod("logic-1"))
+	d, err := NewDiscovery(client, Namespace("im"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+
+	w, err := d.Watch(ctx, "logic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := next(t, w)
+	if len(ss) != 2 {
+		t.Fatalf("expected 2 instances, got %+v", ss)
+	}
+	in := ss[0]
+	if in.ID != "logic-0" || in.Name != "logic" || in.Version != "v1.2.0" {
+		t.Fatalf("unexpected instance %+v", in)
+	}
+	if len(in.Endpoints) != 2 || in.Endpoints[0] != "grpc://10.0.0.1:9000" || in.Endpoints[1] != "http://10.0.0.1:8000" {
+		t.Fatalf("unexpected endpoints %v", in.Endpoints)
+	}
+	md := in.Metadata
+	if md[MetadataZone] != "sh-a" || md[MetadataNode] != "node-1" || md["app"] != "logic" || md["weight"] != "10" {
+		t.Fatalf("unexpected metadata %v", md)
+	}
+	if _, ok := md[corev1.LastAppliedConfigAnnotation]; ok {
+		t.Fatalf("unexpected annotation in metadata %v", md)
+	}
+
+	// 端点变为未就绪后被移除
+	if _, err = client.DiscoveryV1().EndpointSlices("im").Update(ctx, newSlice(false), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ss = next(t, w); len(ss) != 1 || ss[0].ID != "logic-0" {
+		t.Fatalf("expected only ready instance, got %+v", ss)
+	}
+	if ss, err = d.GetService(ctx, "logic"); err != nil || len(ss) != 1 {
+		t.Fatalf("unexpected instances %v, %v", ss, err)
+	}
+
+	_ = d.Close()
+	if _, err = w.Next(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	ports := []discoveryv1.EndpointPort{
+		{Name: ptr("rpc"), AppProtocol: ptr("kubernetes.io/h2c"), Port: ptr[int32](9000)},
+		{Name: ptr("web"), AppProtocol: ptr("http"), Port: ptr[int32](8000)},
+		{Name: ptr("admin"), AppProtocol: ptr("example.com/custom"), Port: ptr[int32](8001)},
+		{Name: ptr("ws"), AppProtocol: ptr("kubernetes.io/ws"), Port: ptr[int32](8002)},
+		{AppProtocol: ptr("example.com/custom"), Port: ptr[int32](9001)},
+		{Port: nil},
+	}
+	want := []string{
+		"grpc://10.0.0.1:9000",
+		"http://10.0.0.1:8000",
+		"admin://10.0.0.1:8001",
+		"ws://10.0.0.1:8002",
+		"grpc://10.0.0.1:9001",
+	}
+	got := endpoints("10.0.0.1", ports)
+	if len(got) != len(want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package kubernetes
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/yanglunara/discovery/register"
+)
+
+var (
+	_ register.Watcher = (*watcher)(nil)
+)
+
+type watcher struct {
+	serviceName string
+	discovery   *Discovery
+	event       chan struct{}
+	first       bool
+	last        []*register.ServiceInstance
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+// Next 等待服务变化, informer 重新同步产生的重复快照会被忽略
+func (w *watcher) Next() ([]*register.ServiceInstance, error) {
+	for {
+		select {
+		case <-w.ctx.Done():
+			return nil, w.ctx.Err()
+		case <-w.discovery.stopCh:
+			return nil, ErrClosed
+		case <-w.event:
+		}
+		ss, err := w.discovery.instances(w.serviceName)
+		if err != nil {
+			return nil, err
+		}
+		if !w.first && reflect.DeepEqual(ss, w.last) {
+			continue
+		}
+		w.first = false
+		w.last = ss
+		return ss, nil
+	}
+}
+
+func (w *watcher) Close() error {
+	w.cancel()
+	w.discovery.unwatch(w)
+	return nil
+}
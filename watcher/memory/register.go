@@ -0,0 +1,239 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yanglunara/discovery/register"
+)
+
+var (
+	_ register.Registrar = (*Registry)(nil)
+	_ register.Discovery = (*Registry)(nil)
+	_ register.Stopper   = (*Registry)(nil)
+
+	ErrClosed = errors.New("memory registry closed")
+)
+
+// Option 注册中心选项
+type Option func(o *options)
+
+type options struct {
+	ttl time.Duration // 实例存活时长, 为 0 时永不过期
+}
+
+// TTL 设置实例存活时长, 超时未重新注册的实例会被移除
+func TTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.ttl = ttl
+	}
+}
+
+type entry struct {
+	ins   *register.ServiceInstance
+	timer *time.Timer
+}
+
+// Registry 内存注册中心, 用于测试及本地开发
+type Registry struct {
+	opts     *options
+	lock     sync.Mutex
+	services map[string]map[string]*entry     // 服务名 -> 实例ID -> 实例
+	watchers map[string]map[*watcher]struct{} // 服务名 -> 观察者
+	closed   bool
+}
+
+func NewRegistry(opts ...Option) *Registry {
+	op := &options{}
+	for _, o := range opts {
+		o(op)
+	}
+	return &Registry{
+		opts:     op,
+		services: make(map[string]map[string]*entry),
+		watchers: make(map[string]map[*watcher]struct{}),
+	}
+}
+
+// Register 注册服务实例, 重复注册同一实例会刷新其存活时间
+func (r *Registry) Register(_ context.Context, service *register.ServiceInstance) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+	set, ok := r.services[service.Name]
+	if !ok {
+		set = make(map[string]*entry)
+		r.services[service.Name] = set
+	}
+	ins := clone(service)
+	ins.LastTs = time.Now().UnixNano()
+	e, ok := set[service.ID]
+	if !ok {
+		e = &entry{}
+		set[service.ID] = e
+	}
+	e.ins = ins
+	if r.opts.ttl > 0 {
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+		e.timer = time.AfterFunc(r.opts.ttl, func() {
+			r.expire(service.Name, service.ID, e)
+		})
+	}
+	r.notify(service.Name)
+	return nil
+}
+
+// Deregister 注销服务实例
+func (r *Registry) Deregister(_ context.Context, service *register.ServiceInstance) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+	r.remove(service.Name, service.ID)
+	return nil
+}
+
+// GetService 获取服务实例, 按实例ID排序
+func (r *Registry) GetService(_ context.Context, serviceName string) ([]*register.ServiceInstance, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil, ErrClosed
+	}
+	return r.snapshot(serviceName), nil
+}
+
+// Watch 创建观察者, 首次 Next 返回当前快照, 之后按变更顺序逐一返回
+func (r *Registry) Watch(ctx context.Context, serviceName string) (register.Watcher, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil, ErrClosed
+	}
+	w := &watcher{
+		serviceName: serviceName,
+		registry:    r,
+		event:       make(chan struct{}, 1),
+	}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	set, ok := r.watchers[serviceName]
+	if !ok {
+		set = make(map[*watcher]struct{})
+		r.watchers[serviceName] = set
+	}
+	set[w] = struct{}{}
+	w.push(r.snapshot(serviceName))
+	return w, nil
+}
+
+// Close 关闭注册中心, 所有观察者返回 ErrClosed
+func (r *Registry) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	for _, set := range r.services {
+		for _, e := range set {
+			if e.timer != nil {
+				e.timer.Stop()
+			}
+		}
+	}
+	for _, set := range r.watchers {
+		for w := range set {
+			w.cancel()
+		}
+	}
+	r.services = make(map[string]map[string]*entry)
+	r.watchers = make(map[string]map[*watcher]struct{})
+	return nil
+}
+
+// expire 实例过期, 仅当实例未被重新注册时移除
+func (r *Registry) expire(name, id string, e *entry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return
+	}
+	if cur, ok := r.services[name][id]; ok && cur == e {
+		r.remove(name, id)
+	}
+}
+
+func (r *Registry) remove(name, id string) {
+	set, ok := r.services[name]
+	if !ok {
+		return
+	}
+	e, ok := set[id]
+	if !ok {
+		return
+	}
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	delete(set, id)
+	if len(set) == 0 {
+		delete(r.services, name)
+	}
+	r.notify(name)
+}
+
+// notify 在持有锁时调用, 保证所有观察者收到的变更顺序一致
+func (r *Registry) notify(name string) {
+	for w := range r.watchers[name] {
+		w.push(r.snapshot(name))
+	}
+}
+
+func (r *Registry) snapshot(name string) []*register.ServiceInstance {
+	set := r.services[name]
+	ss := make([]*register.ServiceInstance, 0, len(set))
+	for _, e := range set {
+		ss = append(ss, clone(e.ins))
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].ID < ss[j].ID
+	})
+	return ss
+}
+
+func (r *Registry) unwatch(w *watcher) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if set, ok := r.watchers[w.serviceName]; ok {
+		delete(set, w)
+		if len(set) == 0 {
+			delete(r.watchers, w.serviceName)
+		}
+	}
+}
+
+func (r *Registry) isClosed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closed
+}
+
+func clone(in *register.ServiceInstance) *register.ServiceInstance {
+	out := *in
+	if in.Metadata != nil {
+		out.Metadata = make(map[string]string, len(in.Metadata))
+		for k, v := range in.Metadata {
+			out.Metadata[k] = v
+		}
+	}
+	out.Endpoints = append([]string(nil), in.Endpoints...)
+	return &out
+}
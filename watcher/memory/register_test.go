@@ -0,0 +1,135 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/yanglunara/discovery/register"
+)
+
+func ids(ss []*register.ServiceInstance) []string {
+	out := make([]string, 0, len(ss))
+	for _, s := range ss {
+		out = append(out, s.ID)
+	}
+	return out
+}
+
+func TestRegistry_Watch(t *testing.T) {
+	ctx := context.Background()
+	r := NewRegistry()
+	defer func() {
+		_ = r.Close()
+	}()
+	w, err := r.Watch(ctx, "helloworld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = w.Close()
+	}()
+
+	steps := []struct {
+		name string
+		do   func() error
+		want []string
+	}{
+		{
+			name: "initial snapshot",
+			do:   func() error { return nil },
+			want: []string{},
+		},
+		{
+			name: "register 2",
+			do: func() error {
+				return r.Register(ctx, &register.ServiceInstance{ID: "2", Name: "helloworld"})
+			},
+			want: []string{"2"},
+		},
+		{
+			name: "register 1",
+			do: func() error {
+				return r.Register(ctx, &register.ServiceInstance{ID: "1", Name: "helloworld"})
+			},
+			want: []string{"1", "2"},
+		},
+		{
+			name: "register other service",
+			do: func() error {
+				return r.Register(ctx, &register.ServiceInstance{ID: "3", Name: "other"})
+			},
+			want: nil,
+		},
+		{
+			name: "deregister 2",
+			do: func() error {
+				return r.Deregister(ctx, &register.ServiceInstance{ID: "2", Name: "helloworld"})
+			},
+			want: []string{"1"},
+		},
+	}
+	// 先执行全部变更, 再按顺序读取, 验证事件不会被合并或乱序
+	var want [][]string
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if step.want != nil {
+			want = append(want, step.want)
+		}
+	}
+	for i, ws := range want {
+		ss, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ids(ss)
+		if len(got) != len(ws) {
+			t.Fatalf("event %d: want %v, got %v", i, ws, got)
+		}
+		for j := range ws {
+			if got[j] != ws[j] {
+				t.Fatalf("event %d: want %v, got %v", i, ws, got)
+			}
+		}
+	}
+
+	_ = r.Close()
+	if _, err = w.Next(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestRegistry_TTL(t *testing.T) {
+	ctx := context.Background()
+	r := NewRegistry(TTL(200 * time.Millisecond))
+	defer func() {
+		_ = r.Close()
+	}()
+	s := &register.ServiceInstance{ID: "1", Name: "helloworld", Metadata: map[string]string{"k": "v"}}
+	if err := r.Register(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	// 返回的实例与注册的实例互不影响
+	ss, _ := r.GetService(ctx, s.Name)
+	ss[0].Metadata["k"] = "changed"
+	if ss, _ = r.GetService(ctx, s.Name); ss[0].Metadata["k"] != "v" {
+		t.Fatalf("registry instance was mutated: %v", ss[0].Metadata)
+	}
+
+	// 续约后不过期
+	time.Sleep(120 * time.Millisecond)
+	if err := r.Register(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(120 * time.Millisecond)
+	if ss, _ = r.GetService(ctx, s.Name); len(ss) != 1 {
+		t.Fatalf("expected instance to be alive, got %v", ss)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if ss, _ = r.GetService(ctx, s.Name); len(ss) != 0 {
+		t.Fatalf("expected instance to expire, got %v", ss)
+	}
+}
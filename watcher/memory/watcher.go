@@ -0,0 +1,67 @@
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/yanglunara/discovery/register"
+)
+
+var (
+	_ register.Watcher = (*watcher)(nil)
+)
+
+type watcher struct {
+	serviceName string
+	registry    *Registry
+	lock        sync.Mutex
+	queue       [][]*register.ServiceInstance // 尚未被 Next 取走的快照, 按变更顺序排列
+	event       chan struct{}
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+func (w *watcher) push(ss []*register.ServiceInstance) {
+	w.lock.Lock()
+	w.queue = append(w.queue, ss)
+	w.lock.Unlock()
+	select {
+	case w.event <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher) pop() ([]*register.ServiceInstance, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.queue) == 0 {
+		return nil, false
+	}
+	ss := w.queue[0]
+	w.queue = w.queue[1:]
+	return ss, true
+}
+
+func (w *watcher) Next() ([]*register.ServiceInstance, error) {
+	for {
+		if err := w.ctx.Err(); err != nil {
+			if w.registry.isClosed() {
+				return nil, ErrClosed
+			}
+			return nil, err
+		}
+		if ss, ok := w.pop(); ok {
+			return ss, nil
+		}
+		select {
+		case <-w.ctx.Done():
+		case <-w.event:
+		}
+	}
+}
+
+func (w *watcher) Close() error {
+	w.cancel()
+	w.registry.unwatch(w)
+	return nil
+}
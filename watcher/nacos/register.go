@@ -0,0 +1,284 @@
+package nacos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/clients/naming_client"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/nacos-group/nacos-sdk-go/v2/vo"
+	"github.com/yanglunara/discovery/register"
+)
+
+var (
+	_ register.Registrar = (*Registry)(nil)
+	_ register.Discovery = (*Registry)(nil)
+	_ register.Stopper   = (*Registry)(nil)
+
+	ErrServiceInstanceNameEmpty = errors.New("nacos: ServiceInstance.Name can not be empty")
+)
+
+// 写入 nacos 实例元数据的字段, 用于还原 ServiceInstance
+const (
+	MetadataID        = "id"
+	MetadataVersion   = "version"
+	MetadataKind      = "kind"
+	MetadataWeight    = "weight"
+	MetadataNamespace = "namespace"
+	MetadataGroup     = "group"
+	MetadataCluster   = "cluster"
+)
+
+// Option 注册中心选项
+type Option func(o *options)
+
+type options struct {
+	namespace string  // 客户端所在的命名空间, 写入实例元数据
+	group     string  // 服务分组
+	cluster   string  // 集群名称
+	weight    float64 // 默认权重
+}
+
+// Namespace 设置客户端所在的命名空间, 默认 public, 需与 nacos 客户端配置的 NamespaceId 一致;
+// 命名空间本身由 nacos 客户端决定, 此处只写入返回实例的元数据, 便于区分实例来源
+func Namespace(ns string) Option {
+	return func(o *options) {
+		o.namespace = ns
+	}
+}
+
+// Group 设置服务分组
+func Group(group string) Option {
+	return func(o *options) {
+		o.group = group
+	}
+}
+
+// Cluster 设置集群名称
+func Cluster(cluster string) Option {
+	return func(o *options) {
+		o.cluster = cluster
+	}
+}
+
+// Weight 设置默认权重, 实例元数据中的 weight 优先
+func Weight(weight float64) Option {
+	return func(o *options) {
+		o.weight = weight
+	}
+}
+
+type Registry struct {
+	opts       *options
+	cli        naming_client.INamingClient
+	lock       sync.Mutex
+	registered map[string]*register.ServiceInstance // 已注册的实例, 关闭时注销
+}
+
+func NewRegistry(cli naming_client.INamingClient, opts ...Option) *Registry {
+	op := &options{
+		namespace: "public",
+		group:     "DEFAULT_GROUP",
+		cluster:   "DEFAULT",
+		weight:    100,
+	}
+	for _, o := range opts {
+		o(op)
+	}
+	return &Registry{
+		opts:       op,
+		cli:        cli,
+		registered: make(map[string]*register.ServiceInstance),
+	}
+}
+
+// Register 注册服务实例, 每个端点对应一个 nacos 临时实例, 由客户端维持心跳
+func (r *Registry) Register(_ context.Context, service *register.ServiceInstance) error {
+	if service.Name == "" {
+		return ErrServiceInstanceNameEmpty
+	}
+	for i, endpoint := range service.Endpoints {
+		if err := r.registerEndpoint(service, endpoint); err != nil {
+			// 部分端点注册失败时回滚已注册的端点, 避免留下未被跟踪的实例
+			for _, registered := range service.Endpoints[:i] {
+				_ = r.deregisterEndpoint(service, registered)
+			}
+			return err
+		}
+	}
+	r.lock.Lock()
+	r.registered[service.Name+"/"+service.ID] = service
+	r.lock.Unlock()
+	return nil
+}
+
+// Deregister 注销服务实例的所有端点, 全部成功后才停止跟踪, 失败的实例在 Close 时重试
+func (r *Registry) Deregister(_ context.Context, service *register.ServiceInstance) error {
+	var errs []error
+	for _, endpoint := range service.Endpoints {
+		if err := r.deregisterEndpoint(service, endpoint); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	r.lock.Lock()
+	delete(r.registered, service.Name+"/"+service.ID)
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *Registry) registerEndpoint(service *register.ServiceInstance, endpoint string) error {
+	host, port, scheme, err := parseEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	md := make(map[string]string, len(service.Metadata)+3)
+	for k, v := range service.Metadata {
+		md[k] = v
+	}
+	md[MetadataID] = service.ID
+	md[MetadataVersion] = service.Version
+	md[MetadataKind] = scheme
+	weight := r.opts.weight
+	if w, err := strconv.ParseFloat(service.Metadata[MetadataWeight], 64); err == nil && w > 0 {
+		weight = w
+	}
+	_, err = r.cli.RegisterInstance(vo.RegisterInstanceParam{
+		Ip:          host,
+		Port:        port,
+		Weight:      weight,
+		Enable:      true,
+		Healthy:     true,
+		Metadata:    md,
+		ClusterName: r.opts.cluster,
+		ServiceName: service.Name,
+		GroupName:   r.opts.group,
+		Ephemeral:   true,
+	})
+	return err
+}
+
+func (r *Registry) deregisterEndpoint(service *register.ServiceInstance, endpoint string) error {
+	host, port, _, err := parseEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	_, err = r.cli.DeregisterInstance(vo.DeregisterInstanceParam{
+		Ip:          host,
+		Port:        port,
+		Cluster:     r.opts.cluster,
+		ServiceName: service.Name,
+		GroupName:   r.opts.group,
+		Ephemeral:   true,
+	})
+	return err
+}
+
+// GetService 获取所在集群中健康的服务实例, 与 Watch 订阅的集群一致
+func (r *Registry) GetService(_ context.Context, serviceName string) ([]*register.ServiceInstance, error) {
+	res, err := r.cli.SelectInstances(vo.SelectInstancesParam{
+		ServiceName: serviceName,
+		GroupName:   r.opts.group,
+		Clusters:    []string{r.opts.cluster},
+		HealthyOnly: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.instances(serviceName, res), nil
+}
+
+// Watch 订阅服务变化
+func (r *Registry) Watch(ctx context.Context, serviceName string) (register.Watcher, error) {
+	return newWatcher(ctx, r, serviceName)
+}
+
+// Close 注销所有通过该注册中心注册的实例, nacos 客户端由调用方负责关闭
+func (r *Registry) Close() error {
+	r.lock.Lock()
+	services := make([]*register.ServiceInstance, 0, len(r.registered))
+	for _, service := range r.registered {
+		services = append(services, service)
+	}
+	r.lock.Unlock()
+	var errs []error
+	for _, service := range services {
+		if err := r.Deregister(context.Background(), service); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// instances 将 nacos 实例按元数据中的实例ID合并为服务实例, 并写入命名空间、分组与集群
+func (r *Registry) instances(serviceName string, list []model.Instance) []*register.ServiceInstance {
+	var (
+		items = make([]*register.ServiceInstance, 0, len(list))
+		byID  = make(map[string]*register.ServiceInstance, len(list))
+	)
+	for _, in := range list {
+		if !in.Enable || !in.Healthy || in.Weight <= 0 {
+			continue
+		}
+		kind := in.Metadata[MetadataKind]
+		if kind == "" {
+			kind = "grpc"
+		}
+		id := in.Metadata[MetadataID]
+		if id == "" {
+			id = in.InstanceId
+		}
+		endpoint := fmt.Sprintf("%s://%s", kind, net.JoinHostPort(in.Ip, strconv.FormatUint(in.Port, 10)))
+		if ins, ok := byID[id]; ok {
+			ins.Endpoints = append(ins.Endpoints, endpoint)
+			continue
+		}
+		md := make(map[string]string, len(in.Metadata)+5)
+		for k, v := range in.Metadata {
+			switch k {
+			case MetadataID, MetadataVersion, MetadataKind:
+				continue
+			}
+			md[k] = v
+		}
+		md[MetadataNamespace] = r.opts.namespace
+		md[MetadataGroup] = r.opts.group
+		md[MetadataCluster] = in.ClusterName
+		md[MetadataWeight] = strconv.FormatFloat(in.Weight, 'f', -1, 64)
+		ins := &register.ServiceInstance{
+			ID:        id,
+			Name:      serviceName,
+			Version:   in.Metadata[MetadataVersion],
+			Metadata:  md,
+			Endpoints: []string{endpoint},
+		}
+		byID[id] = ins
+		items = append(items, ins)
+	}
+	for _, ins := range items {
+		sort.Strings(ins.Endpoints)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ID < items[j].ID
+	})
+	return items
+}
+
+func parseEndpoint(endpoint string) (host string, port uint64, scheme string, err error) {
+	raw, err := url.Parse(endpoint)
+	if err != nil {
+		return "", 0, "", err
+	}
+	if port, err = strconv.ParseUint(raw.Port(), 10, 16); err != nil {
+		return "", 0, "", fmt.Errorf("nacos: invalid endpoint %s: %w", endpoint, err)
+	}
+	return raw.Hostname(), port, raw.Scheme, nil
+}
@@ -0,0 +1,267 @@
+package nacos
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/clients/naming_client"
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/nacos-group/nacos-sdk-go/v2/vo"
+	"github.com/yanglunara/discovery/register"
+)
+
+// fakeNamingClient 在内存中模拟 nacos 的注册与订阅
+type fakeNamingClient struct {
+	naming_client.INamingClient
+	lock      sync.Mutex
+	instances map[string][]model.Instance
+	subs      map[string][]*vo.SubscribeParam
+	failPort  uint64 // 注册或注销该端口时返回错误
+}
+
+func newFakeNamingClient() *fakeNamingClient {
+	return &fakeNamingClient{
+		instances: make(map[string][]model.Instance),
+		subs:      make(map[string][]*vo.SubscribeParam),
+	}
+}
+
+func (f *fakeNamingClient) key(service, group string) string {
+	return group + "@@" + service
+}
+
+func (f *fakeNamingClient) publish(key string) {
+	list := append([]model.Instance(nil), f.instances[key]...)
+	for _, p := range f.subs[key] {
+		p.SubscribeCallback(list, nil)
+	}
+}
+
+func (f *fakeNamingClient) RegisterInstance(p vo.RegisterInstanceParam) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !p.Ephemeral {
+		return false, fmt.Errorf("expected ephemeral instance")
+	}
+	if p.Port == f.failPort {
+		return false, fmt.Errorf("register %s:%d failed", p.Ip, p.Port)
+	}
+	key := f.key(p.ServiceName, p.GroupName)
+	f.instances[key] = append(f.instances[key], model.Instance{
+		InstanceId:  fmt.Sprintf("%s#%d#%s", p.Ip, p.Port, p.ClusterName),
+		Ip:          p.Ip,
+		Port:        p.Port,
+		Weight:      p.Weight,
+		Healthy:     p.Healthy,
+		Enable:      p.Enable,
+		Ephemeral:   p.Ephemeral,
+		ClusterName: p.ClusterName,
+		ServiceName: p.ServiceName,
+		Metadata:    p.Metadata,
+	})
+	f.publish(key)
+	return true, nil
+}
+
+func (f *fakeNamingClient) DeregisterInstance(p vo.DeregisterInstanceParam) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if p.Port == f.failPort {
+		return false, fmt.Errorf("deregister %s:%d failed", p.Ip, p.Port)
+	}
+	key := f.key(p.ServiceName, p.GroupName)
+	list := f.instances[key][:0]
+	for _, in := range f.instances[key] {
+		if in.Ip == p.Ip && in.Port == p.Port {
+			continue
+		}
+		list = append(list, in)
+	}
+	f.instances[key] = list
+	f.publish(key)
+	return true, nil
+}
+
+func (f *fakeNamingClient) SelectInstances(p vo.SelectInstancesParam) ([]model.Instance, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var list []model.Instance
+	for _, in := range f.instances[f.key(p.ServiceName, p.GroupName)] {
+		if len(p.Clusters) > 0 && !slices.Contains(p.Clusters, in.ClusterName) {
+			continue
+		}
+		list = append(list, in)
+	}
+	return list, nil
+}
+
+func (f *fakeNamingClient) setFailPort(port uint64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failPort = port
+}
+
+func (f *fakeNamingClient) Subscribe(p *vo.SubscribeParam) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := f.key(p.ServiceName, p.GroupName)
+	f.subs[key] = append(f.subs[key], p)
+	return nil
+}
+
+func (f *fakeNamingClient) Unsubscribe(p *vo.SubscribeParam) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := f.key(p.ServiceName, p.GroupName)
+	subs := f.subs[key][:0]
+	for _, s := range f.subs[key] {
+		if s != p {
+			subs = append(subs, s)
+		}
+	}
+	f.subs[key] = subs
+	return nil
+}
+
+func next(t *testing.T, w register.Watcher) []*register.ServiceInstance {
+	t.Helper()
+	ch := make(chan []*register.ServiceInstance, 1)
+	go func() {
+		ss, err := w.Next()
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- ss
+	}()
+	select {
+	case ss := <-ch:
+		return ss
+	case <-time.After(3 * time.Second):
+		t.Fatal("next timeout")
+	}
+	return nil
+}
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	cli := newFakeNamingClient()
+	r := NewRegistry(cli, Namespace("dev"), Group("im"))
+
+	w, err := r.Watch(ctx, "logic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = w.Close()
+	}()
+	if ss := next(t, w); len(ss) != 0 {
+		t.Fatalf("expected no instances, got %v", ss)
+	}
+
+	s := &register.ServiceInstance{
+		ID:        "1",
+		Name:      "logic",
+		Version:   "v1.0.0",
+		Metadata:  map[string]string{"dc": "sh", MetadataWeight: "20"},
+		Endpoints: []string{"grpc://127.0.0.1:9000", "http://127.0.0.1:8000"},
+	}
+	if err = r.Register(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	ss := next(t, w)
+	if len(ss) != 1 {
+		t.Fatalf("expected one merged instance, got %+v", ss)
+	}
+	got := ss[0]
+	if got.ID != s.ID || got.Version != s.Version || len(got.Endpoints) != 2 ||
+		got.Endpoints[0] != "grpc://127.0.0.1:9000" || got.Endpoints[1] != "http://127.0.0.1:8000" {
+		t.Fatalf("unexpected instance %+v", got)
+	}
+	md := got.Metadata
+	if md["dc"] != "sh" || md[MetadataNamespace] != "dev" || md[MetadataGroup] != "im" ||
+		md[MetadataCluster] != "DEFAULT" || md[MetadataWeight] != "20" {
+		t.Fatalf("unexpected metadata %v", md)
+	}
+	if _, ok := md[MetadataKind]; ok {
+		t.Fatalf("internal metadata leaked %v", md)
+	}
+
+	if ss, err = r.GetService(ctx, "logic"); err != nil || len(ss) != 1 {
+		t.Fatalf("unexpected instances %v, %v", ss, err)
+	}
+
+	// 关闭注册中心时注销已注册的实例
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if ss = next(t, w); len(ss) != 0 {
+		t.Fatalf("expected no instances after close, got %+v", ss)
+	}
+}
+
+func TestRegistry_Cluster(t *testing.T) {
+	ctx := context.Background()
+	cli := newFakeNamingClient()
+	other := NewRegistry(cli, Cluster("other"))
+	_ = other.Register(ctx, &register.ServiceInstance{ID: "2", Name: "logic", Endpoints: []string{"grpc://127.0.0.2:9000"}})
+	r := NewRegistry(cli)
+	_ = r.Register(ctx, &register.ServiceInstance{ID: "1", Name: "logic", Endpoints: []string{"grpc://127.0.0.1:9000"}})
+
+	// 首次快照与订阅使用相同的集群过滤
+	w, err := r.Watch(ctx, "logic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = w.Close()
+	}()
+	ss := next(t, w)
+	if len(ss) != 1 || ss[0].ID != "1" {
+		t.Fatalf("expected instances of own cluster only, got %+v", ss)
+	}
+	// 未设置命名空间时为 public
+	if ns := ss[0].Metadata[MetadataNamespace]; ns != "public" {
+		t.Fatalf("namespace = %q, want public", ns)
+	}
+}
+
+func TestRegistry_PartialFailure(t *testing.T) {
+	ctx := context.Background()
+	cli := newFakeNamingClient()
+	r := NewRegistry(cli)
+	s := &register.ServiceInstance{
+		ID:        "1",
+		Name:      "logic",
+		Endpoints: []string{"grpc://127.0.0.1:9000", "http://127.0.0.1:8000"},
+	}
+
+	// 部分端点注册失败时回滚已注册的端点
+	cli.setFailPort(8000)
+	if err := r.Register(ctx, s); err == nil {
+		t.Fatal("expected register error")
+	}
+	if ss, _ := r.GetService(ctx, "logic"); len(ss) != 0 {
+		t.Fatalf("expected rollback, got %+v", ss)
+	}
+
+	// 注销失败时继续跟踪, 关闭时重试
+	cli.setFailPort(0)
+	if err := r.Register(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	cli.setFailPort(8000)
+	if err := r.Deregister(ctx, s); err == nil {
+		t.Fatal("expected deregister error")
+	}
+	cli.setFailPort(0)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if ss, _ := r.GetService(ctx, "logic"); len(ss) != 0 {
+		t.Fatalf("expected instances deregistered on close, got %+v", ss)
+	}
+}
@@ -0,0 +1,86 @@
+package nacos
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nacos-group/nacos-sdk-go/v2/model"
+	"github.com/nacos-group/nacos-sdk-go/v2/vo"
+	"github.com/yanglunara/discovery/register"
+)
+
+var (
+	_ register.Watcher = (*watcher)(nil)
+)
+
+type watcher struct {
+	serviceName string
+	registry    *Registry
+	param       *vo.SubscribeParam
+	event       chan struct{}
+	lock        sync.Mutex
+	ss          []*register.ServiceInstance // 订阅回调推送的最新实例
+	pushed      bool
+	first       bool
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+func newWatcher(ctx context.Context, r *Registry, serviceName string) (*watcher, error) {
+	w := &watcher{
+		serviceName: serviceName,
+		registry:    r,
+		event:       make(chan struct{}, 1),
+		first:       true,
+	}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	w.param = &vo.SubscribeParam{
+		ServiceName: serviceName,
+		GroupName:   r.opts.group,
+		Clusters:    []string{r.opts.cluster},
+		SubscribeCallback: func(services []model.Instance, err error) {
+			if err != nil {
+				return
+			}
+			w.lock.Lock()
+			w.ss = r.instances(serviceName, services)
+			w.pushed = true
+			w.lock.Unlock()
+			select {
+			case w.event <- struct{}{}:
+			default:
+			}
+		},
+	}
+	if err := r.cli.Subscribe(w.param); err != nil {
+		w.cancel()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Next 首次返回当前健康实例, 之后等待订阅回调推送
+func (w *watcher) Next() ([]*register.ServiceInstance, error) {
+	if w.first {
+		w.first = false
+		w.lock.Lock()
+		pushed := w.pushed
+		w.lock.Unlock()
+		if !pushed {
+			return w.registry.GetService(w.ctx, w.serviceName)
+		}
+	}
+	select {
+	case <-w.ctx.Done():
+		return nil, w.ctx.Err()
+	case <-w.event:
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.ss, nil
+}
+
+func (w *watcher) Close() error {
+	w.cancel()
+	return w.registry.cli.Unsubscribe(w.param)
+}
@@ -0,0 +1,300 @@
+package zookeeper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	"github.com/yanglunara/discovery/register"
+)
+
+var (
+	_ register.Registrar = (*Registry)(nil)
+	_ register.Discovery = (*Registry)(nil)
+	_ register.Stopper   = (*Registry)(nil)
+)
+
+// zkConn 注册中心使用的 zookeeper 连接方法, *zk.Conn 实现了该接口
+type zkConn interface {
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Delete(path string, version int32) error
+	Exists(path string) (bool, *zk.Stat, error)
+	ExistsW(path string) (bool, *zk.Stat, <-chan zk.Event, error)
+	Get(path string) ([]byte, *zk.Stat, error)
+	Children(path string) ([]string, *zk.Stat, error)
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+}
+
+// 重新创建节点失败时的重试间隔
+const (
+	minRetry = time.Second
+	maxRetry = 30 * time.Second
+)
+
+// Option 注册中心选项
+type Option func(o *options)
+
+type options struct {
+	namespace string
+	acl       []zk.ACL
+}
+
+// Namespace 设置根节点, 服务实例写在 /<namespace>/<service>/ 下
+func Namespace(ns string) Option {
+	return func(o *options) {
+		o.namespace = ns
+	}
+}
+
+// ACL 设置创建节点使用的权限
+func ACL(acl []zk.ACL) Option {
+	return func(o *options) {
+		o.acl = acl
+	}
+}
+
+type Registry struct {
+	opts   *options
+	conn   zkConn
+	lock   sync.Mutex
+	ctxMap map[string]*registration // 服务名/实例ID -> 注册信息
+}
+
+// registration 已注册的实例, 节点因会话过期被删除时重新创建
+type registration struct {
+	path   string
+	cancel context.CancelFunc
+	lock   sync.Mutex
+}
+
+func NewRegistry(conn *zk.Conn, opts ...Option) *Registry {
+	return newRegistry(conn, opts...)
+}
+
+func newRegistry(conn zkConn, opts ...Option) *Registry {
+	op := &options{
+		namespace: "microservices",
+		acl:       zk.WorldACL(zk.PermAll),
+	}
+	for _, o := range opts {
+		o(op)
+	}
+	return &Registry{
+		opts:   op,
+		conn:   conn,
+		ctxMap: make(map[string]*registration),
+	}
+}
+
+func (r *Registry) servicePath(name string) string {
+	return path.Join("/", r.opts.namespace, name)
+}
+
+// Register 以临时顺序节点注册服务实例, 节点名为 <实例ID>-<序号>
+func (r *Registry) Register(_ context.Context, service *register.ServiceInstance) error {
+	data, err := json.Marshal(service)
+	if err != nil {
+		return err
+	}
+	prefix := r.servicePath(service.Name)
+	if err = r.ensurePath(prefix); err != nil {
+		return err
+	}
+	nodePath, err := r.create(prefix, service.ID, data)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	reg := &registration{path: nodePath, cancel: cancel}
+	key := service.Name + "/" + service.ID
+	r.lock.Lock()
+	old, ok := r.ctxMap[key]
+	r.ctxMap[key] = reg
+	r.lock.Unlock()
+	// 同一实例重复注册时删除旧节点
+	if ok {
+		old.cancel()
+		_ = r.conn.Delete(old.currentPath(), -1)
+	}
+	go r.keepNode(ctx, reg, prefix, service.ID, data)
+	return nil
+}
+
+// Deregister 删除服务实例节点
+func (r *Registry) Deregister(_ context.Context, service *register.ServiceInstance) error {
+	key := service.Name + "/" + service.ID
+	r.lock.Lock()
+	reg, ok := r.ctxMap[key]
+	delete(r.ctxMap, key)
+	r.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	reg.cancel()
+	if err := r.conn.Delete(reg.currentPath(), -1); err != nil && !errors.Is(err, zk.ErrNoNode) {
+		return err
+	}
+	return nil
+}
+
+// GetService 获取服务实例
+func (r *Registry) GetService(_ context.Context, serviceName string) ([]*register.ServiceInstance, error) {
+	prefix := r.servicePath(serviceName)
+	children, _, err := r.conn.Children(prefix)
+	if err != nil {
+		if errors.Is(err, zk.ErrNoNode) {
+			return []*register.ServiceInstance{}, nil
+		}
+		return nil, err
+	}
+	return r.instances(prefix, children)
+}
+
+// Watch 基于子节点监听创建观察者
+func (r *Registry) Watch(ctx context.Context, serviceName string) (register.Watcher, error) {
+	prefix := r.servicePath(serviceName)
+	if err := r.ensurePath(prefix); err != nil {
+		return nil, err
+	}
+	return newWatcher(ctx, r, prefix), nil
+}
+
+// Close 删除所有通过该注册中心注册的节点, zookeeper 连接由调用方负责关闭
+func (r *Registry) Close() error {
+	r.lock.Lock()
+	regs := make([]*registration, 0, len(r.ctxMap))
+	for _, reg := range r.ctxMap {
+		regs = append(regs, reg)
+	}
+	r.ctxMap = make(map[string]*registration)
+	r.lock.Unlock()
+	for _, reg := range regs {
+		reg.cancel()
+		_ = r.conn.Delete(reg.currentPath(), -1)
+	}
+	return nil
+}
+
+func (r *Registry) create(prefix, id string, data []byte) (string, error) {
+	return r.conn.Create(prefix+"/"+id+"-", data, zk.FlagEphemeral|zk.FlagSequence, r.opts.acl)
+}
+
+// ensurePath 逐级创建持久节点
+func (r *Registry) ensurePath(p string) error {
+	cur := ""
+	for _, part := range strings.Split(strings.Trim(p, "/"), "/") {
+		cur += "/" + part
+		exists, _, err := r.conn.Exists(cur)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err = r.conn.Create(cur, nil, 0, r.opts.acl); err != nil && !errors.Is(err, zk.ErrNodeExists) {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepNode 监听实例节点, 节点因会话过期被删除后重新创建
+func (r *Registry) keepNode(ctx context.Context, reg *registration, prefix, id string, data []byte) {
+	// 连接、权限等错误不会自行恢复, 按指数退避重试, 避免频繁请求 zookeeper
+	retry := minRetry
+	wait := func() bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > maxRetry {
+			retry = maxRetry
+		}
+		return true
+	}
+	for {
+		exists, _, event, err := r.conn.ExistsW(reg.currentPath())
+		if err != nil {
+			if !wait() {
+				return
+			}
+			continue
+		}
+		if exists {
+			select {
+			case <-ctx.Done():
+				return
+			case ev := <-event:
+				if ev.Type != zk.EventNodeDeleted {
+					continue
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err = r.ensurePath(prefix); err != nil {
+			if !wait() {
+				return
+			}
+			continue
+		}
+		nodePath, err := r.create(prefix, id, data)
+		if err != nil {
+			if !wait() {
+				return
+			}
+			continue
+		}
+		retry = minRetry
+		reg.lock.Lock()
+		reg.path = nodePath
+		reg.lock.Unlock()
+		// 创建期间被注销时删除新节点
+		if ctx.Err() != nil {
+			_ = r.conn.Delete(nodePath, -1)
+			return
+		}
+	}
+}
+
+func (reg *registration) currentPath() string {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	return reg.path
+}
+
+// instances 读取子节点数据, 同一实例ID只保留序号最大的节点
+func (r *Registry) instances(prefix string, children []string) ([]*register.ServiceInstance, error) {
+	sort.Strings(children)
+	byID := make(map[string]*register.ServiceInstance, len(children))
+	for _, child := range children {
+		data, _, err := r.conn.Get(prefix + "/" + child)
+		if err != nil {
+			if errors.Is(err, zk.ErrNoNode) {
+				continue
+			}
+			return nil, err
+		}
+		si := new(register.ServiceInstance)
+		if err = json.Unmarshal(data, si); err != nil {
+			return nil, err
+		}
+		byID[si.ID] = si
+	}
+	items := make([]*register.ServiceInstance, 0, len(byID))
+	for _, si := range byID {
+		items = append(items, si)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ID < items[j].ID
+	})
+	return items, nil
+}
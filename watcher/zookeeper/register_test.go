@@ -0,0 +1,272 @@
+package zookeeper
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	"github.com/yanglunara/discovery/register"
+)
+
+// fakeConn 在内存中模拟 zookeeper 的节点与一次性监听
+type fakeConn struct {
+	lock          sync.Mutex
+	nodes         map[string][]byte
+	ephemeral     map[string]bool
+	seq           int
+	childWatches  map[string][]chan zk.Event
+	existsWatches map[string][]chan zk.Event
+	createErr     error // 非空时创建临时节点返回该错误
+	creates       int   // 创建临时节点的次数
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		nodes:         map[string][]byte{"/": nil},
+		ephemeral:     make(map[string]bool),
+		childWatches:  make(map[string][]chan zk.Event),
+		existsWatches: make(map[string][]chan zk.Event),
+	}
+}
+
+func (f *fakeConn) fire(watches map[string][]chan zk.Event, p string, typ zk.EventType) {
+	for _, ch := range watches[p] {
+		ch <- zk.Event{Type: typ, Path: p}
+	}
+	delete(watches, p)
+}
+
+func (f *fakeConn) Create(p string, data []byte, flags int32, _ []zk.ACL) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if flags&zk.FlagEphemeral != 0 {
+		f.creates++
+		if f.createErr != nil {
+			return "", f.createErr
+		}
+	}
+	if flags&zk.FlagSequence != 0 {
+		f.seq++
+		p = fmt.Sprintf("%s%010d", p, f.seq)
+	}
+	if _, ok := f.nodes[p]; ok {
+		return "", zk.ErrNodeExists
+	}
+	if _, ok := f.nodes[path.Dir(p)]; !ok {
+		return "", zk.ErrNoNode
+	}
+	f.nodes[p] = data
+	f.ephemeral[p] = flags&zk.FlagEphemeral != 0
+	f.fire(f.childWatches, path.Dir(p), zk.EventNodeChildrenChanged)
+	f.fire(f.existsWatches, p, zk.EventNodeCreated)
+	return p, nil
+}
+
+func (f *fakeConn) Delete(p string, _ int32) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.nodes[p]; !ok {
+		return zk.ErrNoNode
+	}
+	delete(f.nodes, p)
+	delete(f.ephemeral, p)
+	f.fire(f.childWatches, path.Dir(p), zk.EventNodeChildrenChanged)
+	f.fire(f.existsWatches, p, zk.EventNodeDeleted)
+	return nil
+}
+
+func (f *fakeConn) Exists(p string) (bool, *zk.Stat, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	_, ok := f.nodes[p]
+	return ok, &zk.Stat{}, nil
+}
+
+func (f *fakeConn) ExistsW(p string) (bool, *zk.Stat, <-chan zk.Event, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	_, ok := f.nodes[p]
+	ch := make(chan zk.Event, 1)
+	f.existsWatches[p] = append(f.existsWatches[p], ch)
+	return ok, &zk.Stat{}, ch, nil
+}
+
+func (f *fakeConn) Get(p string) ([]byte, *zk.Stat, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	data, ok := f.nodes[p]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	return data, &zk.Stat{}, nil
+}
+
+func (f *fakeConn) children(p string) ([]string, error) {
+	if _, ok := f.nodes[p]; !ok {
+		return nil, zk.ErrNoNode
+	}
+	var out []string
+	for node := range f.nodes {
+		if node != p && path.Dir(node) == p {
+			out = append(out, path.Base(node))
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeConn) Children(p string) ([]string, *zk.Stat, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	out, err := f.children(p)
+	return out, &zk.Stat{}, err
+}
+
+func (f *fakeConn) ChildrenW(p string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	out, err := f.children(p)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ch := make(chan zk.Event, 1)
+	f.childWatches[p] = append(f.childWatches[p], ch)
+	return out, &zk.Stat{}, ch, nil
+}
+
+// expireSession 模拟会话过期, 删除所有临时节点
+func (f *fakeConn) expireSession() {
+	f.lock.Lock()
+	var nodes []string
+	for p, e := range f.ephemeral {
+		if e {
+			nodes = append(nodes, p)
+		}
+	}
+	f.lock.Unlock()
+	for _, p := range nodes {
+		_ = f.Delete(p, -1)
+	}
+}
+
+func (f *fakeConn) failCreate(err error) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.createErr = err
+	return f.creates
+}
+
+func next(t *testing.T, w register.Watcher) []*register.ServiceInstance {
+	t.Helper()
+	ch := make(chan []*register.ServiceInstance, 1)
+	go func() {
+		ss, err := w.Next()
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- ss
+	}()
+	select {
+	case ss := <-ch:
+		return ss
+	case <-time.After(3 * time.Second):
+		t.Fatal("next timeout")
+	}
+	return nil
+}
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	conn := newFakeConn()
+	r := newRegistry(conn, Namespace("im"))
+
+	w, err := r.Watch(ctx, "logic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = w.Close()
+	}()
+	if ss := next(t, w); len(ss) != 0 {
+		t.Fatalf("expected no instances, got %v", ss)
+	}
+
+	s := &register.ServiceInstance{
+		ID:        "1",
+		Name:      "logic",
+		Version:   "v1.0.0",
+		Endpoints: []string{"grpc://127.0.0.1:9000"},
+	}
+	if err = r.Register(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	ss := next(t, w)
+	if len(ss) != 1 || ss[0].ID != "1" || ss[0].Endpoints[0] != s.Endpoints[0] {
+		t.Fatalf("unexpected instances %+v", ss)
+	}
+	children, _, _ := conn.Children("/im/logic")
+	if len(children) != 1 || !strings.HasPrefix(children[0], "1-") || !conn.ephemeral["/im/logic/"+children[0]] {
+		t.Fatalf("expected one ephemeral sequential node, got %v", children)
+	}
+
+	// 会话过期后重新创建节点
+	conn.expireSession()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if ss, err = r.GetService(ctx, "logic"); err == nil && len(ss) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node was not recreated, got %v, %v", ss, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err = r.Deregister(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if ss, err = r.GetService(ctx, "logic"); err != nil || len(ss) != 0 {
+		t.Fatalf("expected no instances after deregister, got %v, %v", ss, err)
+	}
+	if ss, err = r.GetService(ctx, "missing"); err != nil || len(ss) != 0 {
+		t.Fatalf("expected no instances for missing service, got %v, %v", ss, err)
+	}
+}
+
+func TestRegistry_CreateBackoff(t *testing.T) {
+	ctx := context.Background()
+	conn := newFakeConn()
+	r := newRegistry(conn, Namespace("im"))
+	defer func() {
+		_ = r.Close()
+	}()
+	s := &register.ServiceInstance{ID: "1", Name: "logic", Endpoints: []string{"grpc://127.0.0.1:9000"}}
+	if err := r.Register(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+
+	// 会话过期后创建节点持续失败时按退避重试, 而不是立即重试
+	before := conn.failCreate(zk.ErrNoAuth)
+	conn.expireSession()
+	time.Sleep(300 * time.Millisecond)
+	if attempts := conn.failCreate(nil) - before; attempts > 1 {
+		t.Fatalf("expected backoff between create attempts, got %d attempts", attempts)
+	}
+
+	// 错误恢复后重新创建节点
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if ss, err := r.GetService(ctx, "logic"); err == nil && len(ss) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("node was not recreated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,67 @@
+package zookeeper
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-zookeeper/zk"
+	"github.com/yanglunara/discovery/register"
+)
+
+var (
+	_ register.Watcher = (*watcher)(nil)
+)
+
+type watcher struct {
+	prefix   string
+	registry *Registry
+	event    <-chan zk.Event
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+func newWatcher(ctx context.Context, r *Registry, prefix string) *watcher {
+	w := &watcher{
+		prefix:   prefix,
+		registry: r,
+	}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	return w
+}
+
+// Next 首次返回当前实例, 之后等待子节点变化
+func (w *watcher) Next() ([]*register.ServiceInstance, error) {
+	if w.event != nil {
+		select {
+		case <-w.ctx.Done():
+			return nil, w.ctx.Err()
+		case ev := <-w.event:
+			if ev.Err != nil {
+				w.event = nil
+				return nil, ev.Err
+			}
+		}
+	}
+	if err := w.ctx.Err(); err != nil {
+		return nil, err
+	}
+	// 子节点监听是一次性的, 每次读取时重新注册
+	children, _, event, err := w.registry.conn.ChildrenW(w.prefix)
+	if errors.Is(err, zk.ErrNoNode) {
+		// 服务节点被删除时重新创建后再监听
+		if err = w.registry.ensurePath(w.prefix); err == nil {
+			children, _, event, err = w.registry.conn.ChildrenW(w.prefix)
+		}
+	}
+	if err != nil {
+		w.event = nil
+		return nil, err
+	}
+	w.event = event
+	return w.registry.instances(w.prefix, children)
+}
+
+func (w *watcher) Close() error {
+	w.cancel()
+	return nil
+}